@@ -1,27 +1,437 @@
 package main
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"io"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sync"
 )
 
+// Partially uploaded files of resumable uploads are kept in this directory under storagePath.
+const UPLOADS_DIRNAME = "uploads"
+
+// Firmware binaries are kept in storage under this prefix by their SHA-256, so the same
+// image uploaded for several firmwares is stored once. Number of firmwares referencing
+// a blob is kept in the blobs table.
+const BLOBS_DIRNAME = "blobs"
+
 type BinariesService struct {
-	cfg *Config
+	cfg     *Config
+	db      Store
+	storage Storage
+
+	// *sync.Mutex by upload id, serializes writes to the same partial file.
+	partialLocks sync.Map
+	// *sync.Mutex by firmware uuid, serializes adding binaries to the same firmware.
+	firmwareLocks sync.Map
+	// Serializes adding and removing references, so a blob isn't removed while being committed.
+	blobsLock sync.Mutex
+}
+
+// Binary written to a temporary file, but not yet available by firmware uuid.
+type StagedBinary struct {
+	path   string
+	Size   int64
+	Md5    string
+	Sha256 string
+}
+
+// Binary, variant or patch in storage.
+type StoredFile struct {
+	key    string
+	Sha256 string // the content is checked against it when read whole
+}
+
+type CorruptedFileError struct {
+	key string
+}
+
+func (e *CorruptedFileError) Error() string {
+	return fmt.Sprintf("stored file '%s' is missing or doesn't match its SHA-256", e.key)
+}
+
+// Blobs are spread over subdirectories by the first byte of the hash.
+func blobKey(sha256 string) string {
+	if len(sha256) < 2 {
+		return path.Join(BLOBS_DIRNAME, sha256)
+	}
+	return path.Join(BLOBS_DIRNAME, sha256[:2], sha256)
+}
+
+func (svc *BinariesService) GetBinaryFile(fi *FirmwareInfo) StoredFile {
+	return StoredFile{blobKey(fi.Sha256), fi.Sha256}
+}
+
+func (svc *BinariesService) GetVariantFile(fi *FirmwareInfo, v *Variant) StoredFile {
+	return StoredFile{fmt.Sprintf("%s.bin.%s", fi.Uuid, v.Encoding), v.Sha256}
+}
+
+func (svc *BinariesService) GetDeltaFile(fi *FirmwareInfo, base *FirmwareInfo, d *Delta) StoredFile {
+	return StoredFile{fmt.Sprintf("%s.%s.patch", fi.Uuid, base.Uuid), d.Sha256}
+}
+
+func (svc *BinariesService) openStored(f StoredFile) (io.ReadSeekCloser, error) {
+	// Binary of a firmware uploaded before SHA-256 was stored and not migrated.
+	if !isHexDigest(f.Sha256, sha256.Size) {
+		return nil, &CorruptedFileError{f.key}
+	}
+
+	r, err := svc.storage.Open(f.key)
+	if _, ok := err.(*ObjectNotFoundError); ok {
+		return nil, &CorruptedFileError{f.key}
+	}
+	return r, err
+}
+
+// Opens stored file, its content is checked against the hash if read from the start
+// to the end, see verifyingReader.
+func (svc *BinariesService) Open(f StoredFile) (io.ReadSeekCloser, error) {
+	r, err := svc.openStored(f)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &verifyingReader{ReadSeekCloser: r, file: f, size: size, h: sha256.New()}, nil
+}
+
+// Hashes the content while it's read sequentially from the start and fails the read
+// of the last byte if it doesn't match, so full downloads of a damaged file are cut
+// short. Seeking elsewhere (Range requests) stops checking, not to read the whole
+// file for a part of it.
+type verifyingReader struct {
+	io.ReadSeekCloser
+	file StoredFile
+	size int64
+	pos  int64
+	h    hash.Hash // nil if not read from the start
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	if r.h != nil {
+		r.h.Write(p[:n])
+	}
+	r.pos += int64(n)
+
+	if r.h != nil && r.pos == r.size {
+		sum := fmt.Sprintf("%x", r.h.Sum(nil))
+		r.h = nil
+		if sum != r.file.Sha256 {
+			log.Printf("stored file '%s' doesn't match its SHA-256", r.file.key)
+			// Holding back the last bytes, the response ends short of its length.
+			return 0, &CorruptedFileError{r.file.key}
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	if pos == 0 {
+		r.h = sha256.New()
+	} else if pos != r.pos {
+		r.h = nil
+	}
+	r.pos = pos
+	return pos, nil
 }
 
-func (svc *BinariesService) GetFirmwareBinaryPath(uuid string) string {
+// Reads stored file checking its content against the hash.
+func (svc *BinariesService) Read(f StoredFile) ([]byte, error) {
+	r, err := svc.openStored(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(data)) != f.Sha256 {
+		return nil, &CorruptedFileError{f.key}
+	}
+	return data, nil
+}
+
+// Returns URL the file can be downloaded from directly, empty if downloads are
+// not redirected. The content isn't checked in this case.
+func (svc *BinariesService) PresignedUrl(f StoredFile) (string, error) {
+	return svc.storage.PresignGet(f.key)
+}
+
+// Where binaries were kept by firmware uuid before the blob store.
+func (svc *BinariesService) legacyBinaryPath(uuid string) string {
 	return filepath.Join(svc.cfg.storagePath, fmt.Sprintf("%s.bin", uuid))
 }
 
-func (svc *BinariesService) AddFirmwareBinary(uuid string, bytes []byte) error {
-	f, err := os.Create(svc.GetFirmwareBinaryPath(uuid))
+func (svc *BinariesService) WriteDelta(fi *FirmwareInfo, base *FirmwareInfo, d *Delta, patch []byte) error {
+	return svc.storage.Put(svc.GetDeltaFile(fi, base, d).key, patch)
+}
+
+// Moves the file to storage.
+func (svc *BinariesService) WriteVariant(fi *FirmwareInfo, v *Variant, path string) error {
+	return svc.storage.PutFile(svc.GetVariantFile(fi, v).key, path)
+}
+
+type UploadOffsetMismatchError struct {
+	given    int64
+	uploaded int64
+}
+
+func (e *UploadOffsetMismatchError) Error() string {
+	return fmt.Sprintf("offset %d doesn't match uploaded size %d", e.given, e.uploaded)
+}
+
+// Computes all digests stored for binaries in one pass.
+type binaryHash struct {
+	io.Writer
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newBinaryHash() *binaryHash {
+	h := &binaryHash{md5: md5.New(), sha256: sha256.New()}
+	h.Writer = io.MultiWriter(h.md5, h.sha256)
+	return h
+}
+
+// Returns hex encoded MD5 and SHA-256.
+func (h *binaryHash) digests() (string, string) {
+	return fmt.Sprintf("%x", h.md5.Sum(nil)), fmt.Sprintf("%x", h.sha256.Sum(nil))
+}
+
+// Hashes the file at path and turns it into staged binary.
+func stageFile(path string) (*StagedBinary, error) {
+	f, err := os.Open(path)
 	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := newBinaryHash()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+
+	sb := &StagedBinary{path: path, Size: size}
+	sb.Md5, sb.Sha256 = h.digests()
+	return sb, nil
+}
+
+// Streams binary to a temporary file in storage (so it can be renamed atomically later)
+// and hashes it on the way.
+func (svc *BinariesService) Stage(r io.Reader) (*StagedBinary, error) {
+	f, err := os.CreateTemp(svc.cfg.storagePath, "upload-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	sb := &StagedBinary{path: f.Name()}
+
+	h := newBinaryHash()
+	sb.Size, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(sb.path)
+		return nil, err
+	}
+
+	sb.Md5, sb.Sha256 = h.digests()
+	return sb, nil
+}
+
+// Moves staged binary to the blob store (unless the same blob is already there) and
+// adds a reference to it, which must be released if the firmware doesn't end up referencing it.
+func (svc *BinariesService) Commit(sb *StagedBinary) error {
+	svc.blobsLock.Lock()
+	defer svc.blobsLock.Unlock()
+
+	// Reference is added first: if the server stops before the rename, the blob is only
+	// kept longer than needed.
+	refs, err := svc.db.AcquireBlob(sb.Sha256, sb.Size)
+	if err != nil {
+		return err
+	}
+
+	key := blobKey(sb.Sha256)
+	exists, err := svc.storage.Exists(key)
+	if err == nil && (refs == 1 || !exists) {
+		err = svc.storage.PutFile(key, sb.path)
+	}
+	if err != nil {
+		svc.db.ReleaseBlob(sb.Sha256)
+	}
+	return err
+}
+
+// Removes a reference to the blob and the blob itself if it was the last one.
+func (svc *BinariesService) Release(sha256 string) error {
+	svc.blobsLock.Lock()
+	defer svc.blobsLock.Unlock()
+
+	refs, err := svc.db.ReleaseBlob(sha256)
+	if err != nil || refs > 0 {
 		return err
 	}
 
+	return svc.storage.Delete(blobKey(sha256))
+}
+
+// Name of MigrateLegacyBinaries in data_migrations.
+const LEGACY_BINARIES_MIGRATION = "legacy_binaries"
+
+// Moves binaries kept by firmware uuid into the blob store, filling in SHA-256 of the
+// firmwares uploaded before it was stored. Binaries not matching their MD5/SHA-256 are
+// left in place. Does nothing once completed, it's safe to run again if interrupted.
+func (svc *BinariesService) MigrateLegacyBinaries() error {
+	applied, err := svc.db.DataMigrationApplied(LEGACY_BINARIES_MIGRATION)
+	if err != nil || applied {
+		return err
+	}
+
+	fis, err := svc.db.GetAllFirmwaresInfo()
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		sb, err := stageFile(svc.legacyBinaryPath(fi.Uuid))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if sb.Md5 != fi.Md5 || (fi.Sha256 != "" && sb.Sha256 != fi.Sha256) {
+			log.Printf("binary of firmware %s doesn't match its digests, not migrated", fi.Uuid)
+			continue
+		}
+		if fi.Sha256 == "" {
+			if err := svc.db.SetFirmwareSha256(fi.Id, sb.Sha256); err != nil {
+				return err
+			}
+		}
+
+		if err := svc.Commit(sb); err != nil {
+			return err
+		}
+		// Still there if the same blob was already stored.
+		os.Remove(sb.path)
+	}
+
+	return svc.db.SetDataMigrationApplied(LEGACY_BINARIES_MIGRATION)
+}
+
+// Removes staged binary, does nothing if it is already committed.
+func (svc *BinariesService) Discard(sb *StagedBinary) {
+	os.Remove(sb.path)
+}
+
+func (svc *BinariesService) partialPath(id string) string {
+	return filepath.Join(svc.cfg.storagePath, UPLOADS_DIRNAME, fmt.Sprintf("%s.part", id))
+}
+
+func (svc *BinariesService) lockPartial(id string) func() {
+	mu, _ := svc.partialLocks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func (svc *BinariesService) lockFirmware(uuid string) func() {
+	mu, _ := svc.firmwareLocks.LoadOrStore(uuid, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func (svc *BinariesService) CreatePartial(id string) error {
+	if err := os.MkdirAll(filepath.Dir(svc.partialPath(id)), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(svc.partialPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Returns number of bytes uploaded so far.
+func (svc *BinariesService) PartialSize(id string) (int64, error) {
+	st, err := os.Stat(svc.partialPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// Appends data to the partial file if offset equals its current size. Data read
+// before an error (e.g. dropped connection) is kept, so upload can be resumed
+// from the returned size.
+func (svc *BinariesService) AppendPartial(id string, offset int64, r io.Reader) (int64, error) {
+	defer svc.lockPartial(id)()
+
+	f, err := os.OpenFile(svc.partialPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
 	defer f.Close()
 
-	_, err = f.Write(bytes)
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if st.Size() != offset {
+		return st.Size(), &UploadOffsetMismatchError{offset, st.Size()}
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	return offset + n, err
+}
+
+// Hashes the partial file and turns it into staged binary. The partial file is
+// consumed by Commit or Discard of the staged binary.
+func (svc *BinariesService) StagePartial(id string) (*StagedBinary, error) {
+	defer svc.lockPartial(id)()
+	defer svc.partialLocks.Delete(id)
+
+	return stageFile(svc.partialPath(id))
+}
+
+func (svc *BinariesService) RemovePartial(id string) error {
+	defer svc.lockPartial(id)()
+	defer svc.partialLocks.Delete(id)
+
+	err := os.Remove(svc.partialPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
 	return err
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestOpenCorruptedBlob(t *testing.T) {
+	svc := newTestFirmwareService(t)
+	data := bytes.Repeat([]byte("firmware "), 10000)
+	fi := addTestFirmwareWithBinary(t, svc, "1.0.0", data)
+	f := svc.bins.GetBinaryFile(fi)
+
+	// Same size, one byte differs.
+	corrupted := bytes.Clone(data)
+	corrupted[len(corrupted)/2] ^= 1
+	if err := os.WriteFile(svc.bins.storage.(*FileStorage).path(f.key), corrupted, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := svc.bins.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	read, err := io.ReadAll(r)
+	if _, ok := err.(*CorruptedFileError); !ok {
+		t.Errorf("reading corrupted blob failed with %v, want CorruptedFileError", err)
+	}
+	if len(read) >= len(data) {
+		t.Errorf("read %d bytes of corrupted blob, the last ones must be held back", len(read))
+	}
+
+	// Range requests aren't checked.
+	if _, err := r.Seek(int64(len(data)/4), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := io.ReadAll(r); err != nil || len(read) != len(data)-len(data)/4 {
+		t.Errorf("read %d bytes of the range, %v", len(read), err)
+	}
+
+	if _, err := svc.bins.Read(f); err == nil {
+		t.Error("Read() of corrupted blob succeeded")
+	}
+}
+
+func TestOpenMissingBlob(t *testing.T) {
+	svc := newTestFirmwareService(t)
+	fi := addTestFirmwareWithBinary(t, svc, "1.0.0", []byte("firmware"))
+	if err := svc.bins.storage.Delete(svc.bins.GetBinaryFile(fi).key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.bins.Open(svc.bins.GetBinaryFile(fi)); err == nil {
+		t.Error("Open() of missing blob succeeded")
+	} else if _, ok := err.(*CorruptedFileError); !ok {
+		t.Errorf("Open() of missing blob error = %v, want CorruptedFileError", err)
+	}
+}
+
+// Blob uploaded for two firmwares is stored once and kept until neither references it.
+func TestSharedBlob(t *testing.T) {
+	svc := newTestFirmwareService(t)
+	data := []byte("firmware")
+	fi1 := addTestFirmwareWithBinary(t, svc, "1.0.0", data)
+	fi2 := addTestFirmwareWithBinary(t, svc, "1.1.0", data)
+	f := svc.bins.GetBinaryFile(fi2)
+
+	if err := svc.bins.Release(fi1.Sha256); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := svc.bins.Read(f); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Read() after releasing one of two references = %q, %v", got, err)
+	}
+
+	if err := svc.bins.Release(fi2.Sha256); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := svc.bins.storage.Exists(f.key); err != nil || exists {
+		t.Errorf("blob exists = %v, %v after releasing the last reference", exists, err)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Port of Colin Percival's bsdiff. The patch uses the layout of BSDIFF43 by Matthew Endsley
+// with zlib instead of bzip2 compression, so it can be applied by a bootloader
+// reading it as a stream with a small inflate implementation:
+//
+//	"OTA/BSDIFF43/ZLB"  16 bytes magic
+//	new size            offtin
+//	zlib stream of the following, repeated until new size bytes are written:
+//	    x, y, z         3 offtins: diff length, extra length, old position adjustment
+//	    x bytes         added bytewise to x bytes of old file at the current position
+//	    y bytes         copied to the new file as is
+//
+// offtin is 8 bytes little-endian sign-magnitude integer (the sign is the top bit of the last byte).
+
+const BSDIFF_MAGIC = "OTA/BSDIFF43/ZLB"
+
+var ErrCorruptPatch = errors.New("corrupt patch")
+
+func putOfftin(buf []byte, x int) {
+	neg := x < 0
+	if neg {
+		x = -x
+	}
+	binary.LittleEndian.PutUint64(buf, uint64(x))
+	if neg {
+		buf[7] |= 0x80
+	}
+}
+
+func offtin(buf []byte) int {
+	x := int(binary.LittleEndian.Uint64(buf) &^ (1 << 63))
+	if buf[7]&0x80 != 0 {
+		return -x
+	}
+	return x
+}
+
+func bsdiffSplit(I []int, V []int, start int, length int, h int) {
+	if length < 16 {
+		for k := start; k < start+length; {
+			j := 1
+			x := V[I[k]+h]
+			for i := 1; k+i < start+length; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := 0; i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+			k += j
+		}
+		return
+	}
+
+	x := V[I[start+length/2]+h]
+	jj, kk := 0, 0
+	for i := start; i < start+length; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, 0, 0
+	for i < jj {
+		if V[I[i]+h] < x {
+			i++
+		} else if V[I[i]+h] == x {
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		} else {
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		bsdiffSplit(I, V, start, jj-start, h)
+	}
+	for i := 0; i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+	if start+length > kk {
+		bsdiffSplit(I, V, kk, start+length-kk, h)
+	}
+}
+
+// Larsson-Sadakane suffix sorting, returns suffix array of old including the empty suffix.
+func qsufsort(old []byte) []int {
+	oldsize := len(old)
+	I := make([]int, oldsize+1)
+	V := make([]int, oldsize+1)
+
+	var buckets [256]int
+	for _, b := range old {
+		buckets[b]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i := 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	for i, b := range old {
+		buckets[b]++
+		I[buckets[b]] = i
+	}
+	I[0] = oldsize
+	for i, b := range old {
+		V[i] = buckets[b]
+	}
+	V[oldsize] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := 1; I[0] != -(oldsize + 1); h += h {
+		length := 0
+		i := 0
+		for i < oldsize+1 {
+			if I[i] < 0 {
+				length -= I[i]
+				i -= I[i]
+			} else {
+				if length != 0 {
+					I[i-length] = -length
+				}
+				length = V[I[i]] + 1 - i
+				bsdiffSplit(I, V, i, length, h)
+				i += length
+				length = 0
+			}
+		}
+		if length != 0 {
+			I[i-length] = -length
+		}
+	}
+
+	for i := 0; i < oldsize+1; i++ {
+		I[V[i]] = i
+	}
+	return I
+}
+
+func matchlen(old []byte, new []byte) int {
+	i := 0
+	for i < len(old) && i < len(new) && old[i] == new[i] {
+		i++
+	}
+	return i
+}
+
+// Finds the longest prefix of new in old using suffix array, returns its position and length.
+func bsdiffSearch(I []int, old []byte, new []byte, st int, en int) (int, int) {
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		if bytes.Compare(old[I[x]:min(len(old), I[x]+len(new))], new[:min(len(new), len(old)-I[x])]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+
+	x := matchlen(old[I[st]:], new)
+	y := matchlen(old[I[en]:], new)
+	if x > y {
+		return I[st], x
+	}
+	return I[en], y
+}
+
+// Returns patch that turns old into new.
+func bsdiff(old []byte, new []byte) []byte {
+	I := qsufsort(old)
+	oldsize, newsize := len(old), len(new)
+
+	var out bytes.Buffer
+	var num [8]byte
+	out.WriteString(BSDIFF_MAGIC)
+	putOfftin(num[:], newsize)
+	out.Write(num[:])
+
+	// Writes to bytes.Buffer don't fail.
+	patch, _ := zlib.NewWriterLevel(&out, zlib.BestCompression)
+	var diff []byte
+
+	scan, length, pos := 0, 0, 0
+	lastscan, lastpos, lastoffset := 0, 0, 0
+	for scan < newsize {
+		oldscore := 0
+		scan += length
+		for scsc := scan; scan < newsize; scan++ {
+			pos, length = bsdiffSearch(I, old, new[scan:], 0, oldsize)
+
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastoffset < oldsize && old[scsc+lastoffset] == new[scsc] {
+					oldscore++
+				}
+			}
+
+			if (length == oldscore && length != 0) || length > oldscore+8 {
+				break
+			}
+
+			if scan+lastoffset < oldsize && old[scan+lastoffset] == new[scan] {
+				oldscore--
+			}
+		}
+
+		if length == oldscore && scan != newsize {
+			continue
+		}
+
+		s, sf, lenf := 0, 0, 0
+		for i := 0; lastscan+i < scan && lastpos+i < oldsize; {
+			if old[lastpos+i] == new[lastscan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenf {
+				sf = s
+				lenf = i
+			}
+		}
+
+		lenb := 0
+		if scan < newsize {
+			s, sb := 0, 0
+			for i := 1; scan >= lastscan+i && pos >= i; i++ {
+				if old[pos-i] == new[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenb {
+					sb = s
+					lenb = i
+				}
+			}
+		}
+
+		if lastscan+lenf > scan-lenb {
+			overlap := (lastscan + lenf) - (scan - lenb)
+			s, ss, lens := 0, 0, 0
+			for i := 0; i < overlap; i++ {
+				if new[lastscan+lenf-overlap+i] == old[lastpos+lenf-overlap+i] {
+					s++
+				}
+				if new[scan-lenb+i] == old[pos-lenb+i] {
+					s--
+				}
+				if s > ss {
+					ss = s
+					lens = i + 1
+				}
+			}
+			lenf += lens - overlap
+			lenb -= lens
+		}
+
+		extra := (scan - lenb) - (lastscan + lenf)
+		putOfftin(num[:], lenf)
+		patch.Write(num[:])
+		putOfftin(num[:], extra)
+		patch.Write(num[:])
+		putOfftin(num[:], (pos-lenb)-(lastpos+lenf))
+		patch.Write(num[:])
+
+		diff = diff[:0]
+		for i := 0; i < lenf; i++ {
+			diff = append(diff, new[lastscan+i]-old[lastpos+i])
+		}
+		patch.Write(diff)
+		patch.Write(new[lastscan+lenf : lastscan+lenf+extra])
+
+		lastscan = scan - lenb
+		lastpos = pos - lenb
+		lastoffset = pos - scan
+	}
+
+	patch.Close()
+	return out.Bytes()
+}
+
+// Applies patch made by bsdiff to old.
+func bspatch(old []byte, patch []byte) ([]byte, error) {
+	header := len(BSDIFF_MAGIC) + 8
+	if len(patch) < header || string(patch[:len(BSDIFF_MAGIC)]) != BSDIFF_MAGIC {
+		return nil, ErrCorruptPatch
+	}
+	newsize := offtin(patch[len(BSDIFF_MAGIC):header])
+	if newsize < 0 {
+		return nil, ErrCorruptPatch
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(patch[header:]))
+	if err != nil {
+		return nil, ErrCorruptPatch
+	}
+	defer r.Close()
+
+	new := make([]byte, newsize)
+	var ctrl [24]byte
+	oldpos, newpos := 0, 0
+	for newpos < newsize {
+		if _, err := io.ReadFull(r, ctrl[:]); err != nil {
+			return nil, ErrCorruptPatch
+		}
+		x, y, z := offtin(ctrl[0:]), offtin(ctrl[8:]), offtin(ctrl[16:])
+		if x < 0 || y < 0 || newpos+x+y > newsize {
+			return nil, ErrCorruptPatch
+		}
+
+		if _, err := io.ReadFull(r, new[newpos:newpos+x]); err != nil {
+			return nil, ErrCorruptPatch
+		}
+		for i := 0; i < x; i++ {
+			if oldpos+i >= 0 && oldpos+i < len(old) {
+				new[newpos+i] += old[oldpos+i]
+			}
+		}
+		newpos += x
+		oldpos += x
+
+		if _, err := io.ReadFull(r, new[newpos:newpos+y]); err != nil {
+			return nil, ErrCorruptPatch
+		}
+		newpos += y
+		oldpos += z
+	}
+
+	return new, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// Firmware-like change of the image: some bytes changed, a block inserted and one removed.
+func editBytes(r *rand.Rand, old []byte) []byte {
+	new := bytes.Clone(old)
+	for i := 0; i < len(new)/100; i++ {
+		new[r.Intn(len(new))] ^= byte(r.Intn(255) + 1)
+	}
+	at := r.Intn(len(new))
+	new = append(new[:at], append(randomBytes(r, 300), new[at:]...)...)
+	at = r.Intn(len(new) - 200)
+	return append(new[:at], new[at+200:]...)
+}
+
+func TestOfftin(t *testing.T) {
+	var buf [8]byte
+	for _, x := range []int{0, 1, -1, 255, -256, 1 << 40, -(1 << 40), 1<<63 - 1, -(1<<63 - 1)} {
+		putOfftin(buf[:], x)
+		if got := offtin(buf[:]); got != x {
+			t.Errorf("offtin(putOfftin(%d)) = %d", x, got)
+		}
+	}
+
+	putOfftin(buf[:], -2)
+	if !bytes.Equal(buf[:], []byte{2, 0, 0, 0, 0, 0, 0, 0x80}) {
+		t.Errorf("putOfftin(-2) = %v, want sign-magnitude", buf)
+	}
+}
+
+func TestBsdiffRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	image := randomBytes(r, 64*1024)
+	text := bytes.Repeat([]byte("firmware version 1.2.3 "), 1000)
+
+	tests := []struct {
+		name     string
+		old, new []byte
+	}{
+		{"both empty", nil, nil},
+		{"empty old", nil, randomBytes(r, 1000)},
+		{"empty new", randomBytes(r, 1000), nil},
+		{"identical", image, image},
+		{"edited", image, editBytes(r, image)},
+		{"edited text", text, bytes.ReplaceAll(text, []byte("1.2.3"), []byte("1.2.4"))},
+		{"unrelated", randomBytes(r, 5000), randomBytes(r, 7000)},
+		{"appended", image[:1000], image[:3000]},
+		{"truncated", image[:3000], image[:1000]},
+		{"one byte", []byte{1}, []byte{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := bsdiff(tt.old, tt.new)
+			got, err := bspatch(tt.old, patch)
+			if err != nil {
+				t.Fatalf("bspatch() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.new) {
+				t.Fatalf("bspatch(bsdiff()) differs from new (%d bytes, want %d)", len(got), len(tt.new))
+			}
+		})
+	}
+}
+
+func TestBsdiffSmallPatch(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	old := randomBytes(r, 64*1024)
+	new := editBytes(r, old)
+
+	if patch := bsdiff(old, new); len(patch) > len(new)/4 {
+		t.Errorf("patch of %d bytes for a small change of %d bytes image", len(patch), len(new))
+	}
+}
+
+func TestBspatchCorrupt(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	old := randomBytes(r, 4096)
+	patch := bsdiff(old, editBytes(r, old))
+
+	badMagic := bytes.Clone(patch)
+	badMagic[0] ^= 0xff
+	negativeSize := bytes.Clone(patch)
+	negativeSize[len(BSDIFF_MAGIC)+7] |= 0x80
+	biggerSize := bytes.Clone(patch)
+	putOfftin(biggerSize[len(BSDIFF_MAGIC):], 1<<20)
+
+	tests := map[string][]byte{
+		"empty":         nil,
+		"header only":   patch[:len(BSDIFF_MAGIC)+8],
+		"truncated":     patch[:len(patch)/2],
+		"bad magic":     badMagic,
+		"negative size": negativeSize,
+		"bigger size":   biggerSize,
+	}
+	for name, p := range tests {
+		if _, err := bspatch(old, p); err != ErrCorruptPatch {
+			t.Errorf("%s: bspatch() error = %v, want ErrCorruptPatch", name, err)
+		}
+	}
+}
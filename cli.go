@@ -1,8 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 )
 
 type CliInvalidUsageError struct{}
@@ -12,38 +16,353 @@ func (e *CliInvalidUsageError) Error() string {
 }
 
 type CliService struct {
-	tokenSvc *TokenService
-	args     []string
+	tokenSvc   *TokenService
+	keysSvc    *SigningKeysService
+	devKeysSvc *DeveloperKeysService
+	db         Store
+	args       []string
 }
 
 func (svc *CliService) ExecuteCliCommands() (string, error) {
-	if len(svc.args) < 3 || len(svc.args) > 4 {
+	if len(svc.args) < 2 {
 		return "", &CliInvalidUsageError{}
 	}
 
-	if svc.args[1] != "token" {
+	switch svc.args[1] {
+	case "token":
+		return svc.newToken()
+	case "tokens":
+		return svc.listTokens()
+	case "revoke":
+		return svc.revokeToken()
+	case "keys":
+		return svc.listKeys()
+	case "key":
+		if len(svc.args) < 3 || svc.args[2] != "rotate" {
+			return "", &CliInvalidUsageError{}
+		}
+		return svc.rotateKey()
+	case "devkeys":
+		return svc.listDevKeys()
+	case "devkey":
+		if len(svc.args) < 3 {
+			return "", &CliInvalidUsageError{}
+		}
+		switch svc.args[2] {
+		case "add":
+			return svc.addDevKey()
+		case "revoke":
+			return svc.revokeDevKey()
+		}
+		return "", &CliInvalidUsageError{}
+	case "migrate":
+		if len(svc.args) == 3 && svc.args[2] == "status" {
+			return svc.migrationStatus()
+		}
+		return svc.migrate()
+	default:
 		return "", &CliInvalidUsageError{}
 	}
+}
 
-	var (
-		isBoard bool
-		sub     string
-	)
+// Collects values of a repeatable flag, each value may also be a comma-separated list.
+type cliListFlag []string
 
-	if len(svc.args) == 4 {
-		if svc.args[3] != "-b" {
-			return "", &CliInvalidUsageError{}
+func (f *cliListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *cliListFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+// Builds scopes from -s and -r flags: every permission given without a repo
+// is granted for each of the repos (or for all repos if none given).
+func cliScopes(isBoard bool, perms []string, repos []string) ([]Scope, error) {
+	if len(repos) == 0 {
+		repos = []string{AnyRepo}
+	}
+	if len(perms) == 0 {
+		if isBoard {
+			perms = []string{string(PermBoard)}
+		} else {
+			perms = []string{string(PermRead), string(PermUpload)}
+		}
+	}
+
+	var scopes []Scope
+	for _, perm := range perms {
+		if perm == string(PermAdmin) || strings.Contains(perm, ":") {
+			scope, err := ParseScope(perm)
+			if err != nil {
+				return nil, err
+			}
+			scopes = append(scopes, scope)
+			continue
 		}
 
-		isBoard = true
-	} else {
-		isBoard = false
+		for _, repo := range repos {
+			scope, err := ParseScope(fmt.Sprintf("%s:%s", perm, repo))
+			if err != nil {
+				return nil, err
+			}
+			scopes = append(scopes, scope)
+		}
 	}
 
-	sub = svc.args[2]
+	return scopes, nil
+}
+
+func (svc *CliService) newToken() (string, error) {
+	if len(svc.args) < 3 || strings.HasPrefix(svc.args[2], "-") {
+		return "", &CliInvalidUsageError{}
+	}
+
+	var perms, repos cliListFlag
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	isBoard := fs.Bool("b", false, "")
+	fs.Var(&perms, "s", "")
+	fs.Var(&repos, "r", "")
+	if err := fs.Parse(svc.args[3:]); err != nil || fs.NArg() != 0 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	scopes, err := cliScopes(*isBoard, perms, repos)
+	if err != nil {
+		return "", err
+	}
 
 	return svc.tokenSvc.New(&TokenSubject{
-		sub,
-		isBoard,
+		svc.args[2],
+		scopes,
 	})
 }
+
+func (svc *CliService) listTokens() (string, error) {
+	if len(svc.args) != 2 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	trs, err := svc.tokenSvc.GetAllTokens()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-36s  %-25s  %-25s  %-25s  %-20s  %s\n",
+		"JTI", "ISSUED", "EXPIRES", "REVOKED", "SUBJECT", "SCOPE")
+	for _, tr := range trs {
+		revoked := "-"
+		if tr.isRevoked() {
+			revoked = tr.RevokedAt.Time.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&sb, "%-36s  %-25s  %-25s  %-25s  %-20s  %s\n",
+			tr.Jti,
+			tr.IssuedAt.Format(time.RFC3339),
+			tr.ExpiresAt.Format(time.RFC3339),
+			revoked,
+			tr.Subject,
+			tr.Scope,
+		)
+	}
+
+	return strings.TrimSuffix(sb.String(), "\n"), nil
+}
+
+func (svc *CliService) revokeToken() (string, error) {
+	if len(svc.args) != 3 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	if err := svc.tokenSvc.Revoke(svc.args[2]); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("token %s revoked", svc.args[2]), nil
+}
+
+func (svc *CliService) listKeys() (string, error) {
+	if len(svc.args) != 2 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	krs, err := svc.keysSvc.GetAllKeys()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-16s  %-5s  %-25s  %s\n", "KID", "ALG", "CREATED", "RETIRES")
+	for _, kr := range krs {
+		retires := "-"
+		if kr.RetiresAt.Valid {
+			retires = kr.RetiresAt.Time.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&sb, "%-16s  %-5s  %-25s  %s\n",
+			kr.Kid,
+			kr.Alg,
+			kr.CreatedAt.Format(time.RFC3339),
+			retires,
+		)
+	}
+
+	return strings.TrimSuffix(sb.String(), "\n"), nil
+}
+
+func (svc *CliService) rotateKey() (string, error) {
+	fs := flag.NewFlagSet("key rotate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	alg := fs.String("a", svc.keysSvc.cfg.jwtKeyAlgorithm, "")
+	grace := fs.Duration("g", svc.keysSvc.cfg.jwtKeyGrace, "")
+	if err := fs.Parse(svc.args[3:]); err != nil || fs.NArg() != 0 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	kr, err := svc.keysSvc.Rotate(*alg, *grace)
+	if err != nil {
+		return "", err
+	}
+
+	retiresAt := kr.CreatedAt.Add(*grace)
+	out := fmt.Sprintf(
+		"new %s key %s is active, previous keys retire at %s",
+		kr.Alg,
+		kr.Kid,
+		retiresAt.Format(time.RFC3339),
+	)
+
+	outlived, err := svc.boardTokensOutliving(kr.CreatedAt, retiresAt)
+	if err != nil {
+		return "", err
+	}
+	if outlived != 0 {
+		out += fmt.Sprintf(
+			"\nwarning: %d board tokens issued before expire after that and will stop working then, reissue them in time",
+			outlived,
+		)
+	}
+	return out, nil
+}
+
+// Counts active board tokens issued before the given time that expire after retiresAt.
+func (svc *CliService) boardTokensOutliving(issuedBefore time.Time, retiresAt time.Time) (int, error) {
+	trs, err := svc.tokenSvc.GetAllTokens()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, tr := range trs {
+		if tr.isRevoked() || !tr.IssuedAt.Before(issuedBefore) || !tr.ExpiresAt.After(retiresAt) {
+			continue
+		}
+		scopes, err := ParseScopes(tr.Scope)
+		if err == nil && (&TokenSubject{tr.Subject, scopes}).isBoard() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (svc *CliService) addDevKey() (string, error) {
+	if len(svc.args) != 5 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	data, err := os.ReadFile(svc.args[4])
+	if err != nil {
+		return "", err
+	}
+
+	kr, err := svc.devKeysSvc.Add(svc.args[3], data)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s key %s registered for %s", kr.Alg, kr.Kid, kr.Subject), nil
+}
+
+func (svc *CliService) listDevKeys() (string, error) {
+	if len(svc.args) != 2 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	krs, err := svc.devKeysSvc.GetAllKeys()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-16s  %-7s  %-25s  %-25s  %s\n", "KID", "ALG", "CREATED", "REVOKED", "SUBJECT")
+	for _, kr := range krs {
+		revoked := "-"
+		if kr.isRevoked() {
+			revoked = kr.RevokedAt.Time.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&sb, "%-16s  %-7s  %-25s  %-25s  %s\n",
+			kr.Kid,
+			kr.Alg,
+			kr.CreatedAt.Format(time.RFC3339),
+			revoked,
+			kr.Subject,
+		)
+	}
+
+	return strings.TrimSuffix(sb.String(), "\n"), nil
+}
+
+func (svc *CliService) revokeDevKey() (string, error) {
+	if len(svc.args) != 4 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	if err := svc.devKeysSvc.Revoke(svc.args[3]); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("developer key %s revoked", svc.args[3]), nil
+}
+
+func (svc *CliService) migrationStatus() (string, error) {
+	statuses, err := svc.db.GetMigrationStatus()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-7s  %-30s  %s\n", "VERSION", "NAME", "APPLIED")
+	for _, ms := range statuses {
+		applied := "pending"
+		if ms.AppliedAt.Valid {
+			applied = ms.AppliedAt.Time.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&sb, "%-7d  %-30s  %s\n", ms.Version, ms.Name, applied)
+	}
+
+	return strings.TrimSuffix(sb.String(), "\n"), nil
+}
+
+func (svc *CliService) migrate() (string, error) {
+	if len(svc.args) != 2 {
+		return "", &CliInvalidUsageError{}
+	}
+
+	applied, err := svc.db.Migrate()
+	for _, m := range applied {
+		fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(applied) == 0 {
+		return "database schema is up to date", nil
+	}
+	return fmt.Sprintf("database schema migrated to version %d", applied[len(applied)-1].Version), nil
+}
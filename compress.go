@@ -0,0 +1,185 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Compressed variants of binaries are generated at upload time for MCU decompressors,
+// which can't afford to receive the whole raw image. They are compressed from the
+// staged file before the firmware is locked, and only moved to storage under the lock.
+
+type Encoding string
+
+const (
+	EncodingGzip       Encoding = "gzip"
+	EncodingHeatshrink Encoding = "heatshrink" // raw stream, window and lookahead sizes are in the config
+	EncodingLzma       Encoding = "lzma"       // .lzma (LZMA-Alone) with the uncompressed size in the header
+)
+
+var ENCODINGS = []Encoding{EncodingGzip, EncodingHeatshrink, EncodingLzma}
+
+// Encodings registered as HTTP content codings, the others aren't negotiated by
+// Accept-Encoding, since generic clients can't decode them.
+var CONTENT_CODINGS = []Encoding{EncodingGzip}
+
+type UnsupportedEncodingError struct {
+	encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported encoding '%s', use gzip, heatshrink or lzma", e.encoding)
+}
+
+type InvalidHeatshrinkParamsError struct {
+	window    int
+	lookahead int
+}
+
+func (e *InvalidHeatshrinkParamsError) Error() string {
+	return fmt.Sprintf("invalid heatshrink params: window %d, lookahead %d (4 <= window <= 15, 3 <= lookahead < window)",
+		e.window, e.lookahead)
+}
+
+// Parses comma-separated list of encodings from the config.
+func ParseEncodings(s string) ([]Encoding, error) {
+	var encodings []Encoding
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !slices.Contains(ENCODINGS, Encoding(e)) {
+			return nil, &UnsupportedEncodingError{e}
+		}
+		encodings = append(encodings, Encoding(e))
+	}
+	return encodings, nil
+}
+
+func ValidateHeatshrinkParams(window int, lookahead int) error {
+	if window < 4 || window > 15 || lookahead < 3 || lookahead >= window {
+		return &InvalidHeatshrinkParamsError{window, lookahead}
+	}
+	return nil
+}
+
+type CompressionService struct {
+	cfg  *Config
+	bins *BinariesService
+}
+
+// Compressed variant of a staged binary, not in storage yet.
+type StagedVariant struct {
+	path     string
+	Encoding Encoding
+	Size     int64
+	Sha256   string
+}
+
+func (svc *CompressionService) newWriter(encoding Encoding, w io.Writer, size int64) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case EncodingHeatshrink:
+		return newHeatshrinkWriter(w, svc.cfg.heatshrinkWindow, svc.cfg.heatshrinkLookahead), nil
+	case EncodingLzma:
+		return lzma.WriterConfig{
+			DictCap:      svc.cfg.lzmaDictSize,
+			SizeInHeader: true,
+			Size:         size,
+		}.NewWriter(w)
+	default:
+		return nil, &UnsupportedEncodingError{string(encoding)}
+	}
+}
+
+// Compresses staged binary to a temporary file as it is read, so large images
+// don't have to fit in memory. Returns nil if the variant isn't smaller than the binary.
+func (svc *CompressionService) stageVariant(sb *StagedBinary, encoding Encoding) (*StagedVariant, error) {
+	in, err := os.Open(sb.path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	f, err := os.CreateTemp(svc.cfg.storagePath, "variant-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	sv := &StagedVariant{path: f.Name(), Encoding: encoding}
+
+	h := sha256.New()
+	w, err := svc.newWriter(encoding, io.MultiWriter(f, h), sb.Size)
+	if err == nil {
+		_, err = io.Copy(w, in)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		sv.Size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || sv.Size >= sb.Size {
+		os.Remove(sv.path)
+		return nil, err
+	}
+
+	sv.Sha256 = fmt.Sprintf("%x", h.Sum(nil))
+	return sv, nil
+}
+
+// Compresses staged binary in configured encodings, skipping the variants not smaller
+// than the binary. They must be stored with StoreVariants or discarded.
+func (svc *CompressionService) StageVariants(sb *StagedBinary) ([]StagedVariant, error) {
+	var svs []StagedVariant
+	for _, encoding := range svc.cfg.encodings {
+		sv, err := svc.stageVariant(sb, encoding)
+		if err != nil {
+			svc.DiscardVariants(svs)
+			return nil, err
+		}
+		if sv != nil {
+			svs = append(svs, *sv)
+		}
+	}
+	return svs, nil
+}
+
+// Moves staged variants of the firmware's binary to storage and returns them.
+func (svc *CompressionService) StoreVariants(fi *FirmwareInfo, svs []StagedVariant) ([]Variant, error) {
+	var variants []Variant
+	for _, sv := range svs {
+		variant := Variant{
+			FirmwareId: fi.Id,
+			Encoding:   sv.Encoding,
+			Size:       sv.Size,
+			Sha256:     sv.Sha256,
+		}
+		if err := svc.bins.WriteVariant(fi, &variant, sv.path); err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+// Removes files of staged variants, does nothing for the ones moved to storage.
+func (svc *CompressionService) DiscardVariants(svs []StagedVariant) {
+	for _, sv := range svs {
+		os.Remove(sv.path)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+func newTestCompressionService(t *testing.T) *CompressionService {
+	t.Helper()
+	svc := newTestFirmwareService(t)
+	svc.cfg.encodings = ENCODINGS
+	svc.cfg.heatshrinkWindow = 8
+	svc.cfg.heatshrinkLookahead = 4
+	svc.cfg.lzmaDictSize = 1 << 16
+	return &CompressionService{svc.cfg, svc.bins}
+}
+
+func decompressVariant(t *testing.T, svc *CompressionService, encoding Encoding, data []byte) []byte {
+	t.Helper()
+	var r io.Reader
+	var err error
+	switch encoding {
+	case EncodingGzip:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case EncodingLzma:
+		r, err = lzma.NewReader(bytes.NewReader(data))
+	case EncodingHeatshrink:
+		return heatshrinkDecompress(t, data, svc.cfg.heatshrinkWindow, svc.cfg.heatshrinkLookahead)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestStageVariants(t *testing.T) {
+	svc := newTestCompressionService(t)
+	r := rand.New(rand.NewSource(1))
+	data := editBytes(r, bytes.Repeat(randomBytes(r, 100), 2000))
+
+	sb, err := svc.bins.Stage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.bins.Discard(sb)
+
+	svs, err := svc.StageVariants(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.DiscardVariants(svs)
+	if len(svs) != len(ENCODINGS) {
+		t.Fatalf("StageVariants() = %+v, want all encodings", svs)
+	}
+
+	for _, sv := range svs {
+		compressed, err := os.ReadFile(sv.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(compressed)) != sv.Size || fmt.Sprintf("%x", sha256.Sum256(compressed)) != sv.Sha256 {
+			t.Errorf("%s: size %d and digest %s don't match the file", sv.Encoding, sv.Size, sv.Sha256)
+		}
+		if got := decompressVariant(t, svc, sv.Encoding, compressed); !bytes.Equal(got, data) {
+			t.Errorf("%s: decompressed %d bytes differ from %d bytes", sv.Encoding, len(got), len(data))
+		}
+	}
+}
+
+func TestStageVariantsNotSmaller(t *testing.T) {
+	svc := newTestCompressionService(t)
+	sb, err := svc.bins.Stage(bytes.NewReader(randomBytes(rand.New(rand.NewSource(1)), 10000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.bins.Discard(sb)
+
+	svs, err := svc.StageVariants(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svs) != 0 {
+		t.Errorf("StageVariants() of random data = %+v", svs)
+	}
+}
+
+func TestStoreVariants(t *testing.T) {
+	svc := newTestCompressionService(t)
+	fi := &FirmwareInfo{Id: 1, Uuid: "firmware"}
+	data := bytes.Repeat([]byte("firmware "), 1000)
+
+	sb, err := svc.bins.Stage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.bins.Discard(sb)
+	svs, err := svc.StageVariants(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.DiscardVariants(svs)
+
+	variants, err := svc.StoreVariants(fi, svs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range variants {
+		if v.FirmwareId != fi.Id || v.Encoding != svs[i].Encoding || v.Sha256 != svs[i].Sha256 {
+			t.Errorf("variant %+v of staged %+v", v, svs[i])
+		}
+		stored, err := svc.bins.Read(svc.bins.GetVariantFile(fi, &v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decompressVariant(t, svc, v.Encoding, stored); !bytes.Equal(got, data) {
+			t.Errorf("%s: stored variant decompresses to %d bytes, want %d", v.Encoding, len(got), len(data))
+		}
+	}
+}
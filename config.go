@@ -1,15 +1,49 @@
 package main
 
-import "gopkg.in/ini.v1"
+import (
+	"time"
+
+	"gopkg.in/ini.v1"
+)
 
 type Config struct {
-	storagePath   string
-	host          string
-	port          string
-	jwtSigningKey string
-	jwtIssuer     string
-	tlsPem        string
-	tlsKey        string
+	storagePath            string
+	databaseDsn            string
+	databaseAutoMigrate    bool
+	host                   string
+	port                   string
+	jwtSigningKey          string
+	jwtIssuer              string
+	jwtLifetime            time.Duration
+	jwtBoardLifetime       time.Duration
+	jwtKeyAlgorithm        string
+	jwtKeyGrace            time.Duration
+	jwtAcceptLegacyTokens  bool
+	binUrlSigningKey       string
+	binUrlLifetime         time.Duration
+	uploadSessionLifetime  time.Duration
+	rolloutMaxFailureRatio float64
+	rolloutMinReports      int
+	firmwareSigningKey     string
+	requireDevSignature    bool
+	deltaBaseVersions      int
+	deltaMaxSize           int
+	encodings              []Encoding
+	heatshrinkWindow       int
+	heatshrinkLookahead    int
+	lzmaDictSize           int
+	storageBackend         string
+	s3Endpoint             string
+	s3Region               string
+	s3Bucket               string
+	s3Prefix               string
+	s3AccessKey            string
+	s3SecretKey            string
+	s3PathStyle            bool
+	s3PresignDownloads     bool
+	s3PresignLifetime      time.Duration
+	tlsPem                 string
+	tlsKey                 string
 }
 
 func LoadConfig() (*Config, error) {
@@ -18,13 +52,54 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
-	return &Config{
-		storagePath:   iniFile.Section("").Key("storagePath").String(),
-		host:          iniFile.Section("").Key("host").String(),
-		port:          iniFile.Section("").Key("port").String(),
-		jwtSigningKey: iniFile.Section("jwt").Key("signingKey").String(),
-		jwtIssuer:     iniFile.Section("jwt").Key("issuer").String(),
-		tlsPem:        iniFile.Section("tls").Key("pem").String(),
-		tlsKey:        iniFile.Section("tls").Key("key").String(),
-	}, nil
+	encodings, err := ParseEncodings(iniFile.Section("compression").Key("encodings").String())
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		storagePath:            iniFile.Section("").Key("storagePath").String(),
+		databaseDsn:            iniFile.Section("database").Key("dsn").String(),
+		databaseAutoMigrate:    iniFile.Section("database").Key("autoMigrate").MustBool(true),
+		host:                   iniFile.Section("").Key("host").String(),
+		port:                   iniFile.Section("").Key("port").String(),
+		jwtSigningKey:          iniFile.Section("jwt").Key("signingKey").String(),
+		jwtIssuer:              iniFile.Section("jwt").Key("issuer").String(),
+		jwtLifetime:            iniFile.Section("jwt").Key("lifetime").MustDuration(30 * 24 * time.Hour),
+		jwtBoardLifetime:       iniFile.Section("jwt").Key("boardLifetime").MustDuration(5 * 365 * 24 * time.Hour),
+		jwtKeyAlgorithm:        iniFile.Section("jwt").Key("keyAlgorithm").MustString("EdDSA"),
+		jwtKeyGrace:            iniFile.Section("jwt").Key("keyGracePeriod").MustDuration(30 * 24 * time.Hour),
+		jwtAcceptLegacyTokens:  iniFile.Section("jwt").Key("acceptLegacyTokens").MustBool(false),
+		binUrlSigningKey:       iniFile.Section("bin").Key("urlSigningKey").String(),
+		binUrlLifetime:         iniFile.Section("bin").Key("urlLifetime").MustDuration(time.Hour),
+		uploadSessionLifetime:  iniFile.Section("upload").Key("sessionLifetime").MustDuration(24 * time.Hour),
+		rolloutMaxFailureRatio: iniFile.Section("rollout").Key("maxFailureRatio").MustFloat64(0.2),
+		rolloutMinReports:      iniFile.Section("rollout").Key("minReports").MustInt(5),
+		firmwareSigningKey:     iniFile.Section("firmware").Key("signingKey").String(),
+		requireDevSignature:    iniFile.Section("firmware").Key("requireDeveloperSignature").MustBool(true),
+		deltaBaseVersions:      iniFile.Section("delta").Key("baseVersions").MustInt(3),
+		deltaMaxSize:           iniFile.Section("delta").Key("maxSize").MustInt(8 * 1024 * 1024),
+		encodings:              encodings,
+		heatshrinkWindow:       iniFile.Section("compression").Key("heatshrinkWindow").MustInt(8),
+		heatshrinkLookahead:    iniFile.Section("compression").Key("heatshrinkLookahead").MustInt(4),
+		lzmaDictSize:           iniFile.Section("compression").Key("lzmaDictSize").MustInt(64 * 1024),
+		storageBackend:         iniFile.Section("storage").Key("backend").MustString(StorageBackendFs),
+		s3Endpoint:             iniFile.Section("s3").Key("endpoint").String(),
+		s3Region:               iniFile.Section("s3").Key("region").MustString("us-east-1"),
+		s3Bucket:               iniFile.Section("s3").Key("bucket").String(),
+		s3Prefix:               iniFile.Section("s3").Key("prefix").String(),
+		s3AccessKey:            iniFile.Section("s3").Key("accessKey").String(),
+		s3SecretKey:            iniFile.Section("s3").Key("secretKey").String(),
+		s3PathStyle:            iniFile.Section("s3").Key("pathStyle").MustBool(true),
+		s3PresignDownloads:     iniFile.Section("s3").Key("presignDownloads").MustBool(false),
+		s3PresignLifetime:      iniFile.Section("s3").Key("presignLifetime").MustDuration(15 * time.Minute),
+		tlsPem:                 iniFile.Section("tls").Key("pem").String(),
+		tlsKey:                 iniFile.Section("tls").Key("key").String(),
+	}
+
+	if err := ValidateHeatshrinkParams(cfg.heatshrinkWindow, cfg.heatshrinkLookahead); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
 }
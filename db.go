@@ -2,291 +2,1643 @@ package main
 
 import (
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 	"path/filepath"
-	"sync"
+	"strings"
 	"time"
 )
 
 type FirmwareInfo struct {
-	Id          int64
-	Uuid        string
-	RepoName    string
-	CommitId    string
-	Boards      []string // not presented in firmwares table
-	CreatedAt   time.Time
-	CreatedBy   string
-	Md5         string
-	Description string
-	Size        int // 0 if no binary file uploaded, empty files are not allowed
+	Id           int64
+	Uuid         string
+	RepoName     string
+	CommitId     string
+	Boards       []string // not presented in firmwares table
+	CreatedAt    time.Time
+	CreatedBy    string
+	Md5          string
+	Description  string
+	Size         int // 0 if no binary file uploaded, empty files are not allowed
+	Channel      Channel
+	Version      string // semantic version, empty for firmwares created before versions were introduced
+	VersionKey   string // sortable form of Version, see Version.key()
+	Sha256       string // empty for files uploaded before SHA-256 was introduced
+	Signature    string // Ed25519 signature of SHA-256, see FirmwareSigner
+	SignatureKid string
+	DevSignature string // signature made by CreatedBy in CI, see DeveloperKeysService
+	DevKid       string
+	Variants     []Variant // not presented in firmwares table
+	// Staged rollout the firmware is created with, nil for all boards. Not read back,
+	// see GetRollout.
+	RolloutPercentage *int
 }
 
 func (fi *FirmwareInfo) hasBin() bool {
 	return fi.Size != 0
 }
 
+func (fi *FirmwareInfo) variant(encoding Encoding) *Variant {
+	for i := range fi.Variants {
+		if fi.Variants[i].Encoding == encoding {
+			return &fi.Variants[i]
+		}
+	}
+	return nil
+}
+
 type FirmwareForBoardRecord struct {
 	BoardName  string
 	FirmwareId int64
 }
 
-type DB struct {
-	*sql.DB
-	sync.Mutex
+type FirmwareSort string
+
+const (
+	SortVersionDesc FirmwareSort = "-version" // by repo, newest versions first
+	SortVersionAsc  FirmwareSort = "version"
+	SortCreatedDesc FirmwareSort = "-created_at"
+	SortCreatedAsc  FirmwareSort = "created_at"
+)
+
+var FIRMWARE_SORTS = []FirmwareSort{SortVersionDesc, SortVersionAsc, SortCreatedDesc, SortCreatedAsc}
+
+// Zero fields don't restrict the list.
+type FirmwareFilter struct {
+	Repos         []string // nil for any repo
+	Board         string
+	CreatedBy     string
+	CommitPrefix  string
+	CreatedAfter  time.Time // inclusive
+	CreatedBefore time.Time // exclusive
+	HasBinary     *bool
+}
+
+// Sort keys of the last firmware of a page, the next page starts after it.
+type FirmwareCursor struct {
+	Sort       FirmwareSort `json:"s"`
+	RepoName   string       `json:"r,omitempty"`
+	VersionKey string       `json:"v,omitempty"`
+	Id         int64        `json:"i"`
+}
+
+type TokenRecord struct {
+	Id        int64
+	Jti       string
+	Subject   string
+	Scope     string // space-separated list of scopes
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	RevokedAt sql.NullTime
+}
+
+func (tr *TokenRecord) isRevoked() bool {
+	return tr.RevokedAt.Valid
+}
+
+type SigningKeyRecord struct {
+	Id        int64
+	Kid       string
+	Alg       string
+	CreatedAt time.Time
+	RetiresAt sql.NullTime // null for the active key
+}
+
+func (kr *SigningKeyRecord) isRetired(now time.Time) bool {
+	return kr.RetiresAt.Valid && !now.Before(kr.RetiresAt.Time)
+}
+
+type DeveloperKeyRecord struct {
+	Id        int64
+	Kid       string
+	Subject   string // token subject the firmware is created by
+	Alg       string
+	PublicKey string // PKIX PEM
+	CreatedAt time.Time
+	RevokedAt sql.NullTime
+}
+
+func (kr *DeveloperKeyRecord) isRevoked() bool {
+	return kr.RevokedAt.Valid
+}
+
+// Binary compressed with one of the encodings.
+type Variant struct {
+	FirmwareId int64
+	Encoding   Encoding
+	Size       int64
+	Sha256     string
+}
+
+// Patch turning binary of the base firmware into binary of the firmware.
+type Delta struct {
+	Id             int64
+	FirmwareId     int64
+	BaseFirmwareId int64
+	Size           int64
+	Sha256         string
+	CreatedAt      time.Time
+}
+
+type DeviceInfo struct {
+	Id            int64
+	Name          string // board name, token subject
+	RepoName      string
+	FirmwareUuid  string // as reported by the board, may be unknown to the server
+	CommitId      string
+	Uptime        int64 // seconds
+	ResetReason   string
+	LastCheckinAt time.Time
+}
+
+type UpdateStatus string
+
+const (
+	UpdateDownloading UpdateStatus = "downloading"
+	UpdateInstalled   UpdateStatus = "installed"
+	UpdateBooted      UpdateStatus = "booted"
+	UpdateRolledBack  UpdateStatus = "rolled_back"
+	UpdateFailed      UpdateStatus = "failed"
+)
+
+type UpdateEvent struct {
+	Id         int64
+	FirmwareId int64
+	DeviceName string
+	Status     UpdateStatus
+	ErrorCode  string // only for failed updates, may be empty
+	CreatedAt  time.Time
+}
+
+// Devices are counted by the last status they reported for the firmware.
+type UpdateStats struct {
+	Devices    int
+	ByStatus   map[UpdateStatus]int
+	ErrorCodes map[string]int // of devices that failed
+}
+
+type BoardSubscription struct {
+	BoardName string
+	RepoName  string
+	Channel   Channel
+}
+
+// Firmwares without rollout record are delivered to all boards.
+type Rollout struct {
+	FirmwareId        int64
+	Percentage        int
+	UpdatedAt         time.Time
+	UpdatedBy         string
+	Paused            bool // paused rollout is not delivered to any board
+	PauseReason       string
+	PausedAt          sql.NullTime
+	ResumedAt         sql.NullTime
+	ResumedAfterEvent int64 // update outcomes up to this event id are ignored by health gate
+}
+
+type UploadSession struct {
+	Id         string
+	FirmwareId int64
+	Size       int64  // declared size of the whole file
+	Md5        string // declared MD5 of the whole file, may be empty
+	CreatedBy  string
+	CreatedAt  time.Time
+	Sha256     string // declared SHA-256 of the whole file, may be empty
+}
+
+// Safe for concurrent use: SQLite is opened in WAL mode, so reads don't wait for
+// writes, and writers wait for each other up to busy timeout (see OpenDB).
+type DB struct {
+	*sql.DB
+	dialect Dialect
+}
+
+// Used if database.dsn is empty.
+const SQLITE_DB_FILENAME = "firmware.db"
+
+// Queries are written with ? placeholders, PostgreSQL wants $1, $2, ...
+func (d Dialect) rebind(query string) string {
+	if d != DialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// SQLite keeps timestamps as text with the offset of the writer's zone, so they
+// are compared as julian days there.
+func (d Dialect) timestamp(expr string) string {
+	if d != DialectSqlite {
+		return expr
+	}
+	return "julianday(" + expr + ")"
+}
+
+func (db *DB) Prepare(query string) (*sql.Stmt, error) {
+	return db.DB.Prepare(db.dialect.rebind(query))
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+// Transaction rebinding placeholders like DB.
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+func (tx *Tx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(tx.dialect.rebind(query))
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" // unique_violation
+}
+
+// Runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise.
+func (db *DB) inTx(fn func(tx *Tx) error) error {
+	sqlTx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	if err := fn(&Tx{sqlTx, db.dialect}); err != nil {
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// Schema is written for SQLite, these are the PostgreSQL types of the same columns.
+// Earlier pairs take precedence.
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"INTEGER", "BIGINT",
+	"DATETIME", "TIMESTAMPTZ",
+	"BOOLEAN NOT NULL DEFAULT 0", "BOOLEAN NOT NULL DEFAULT FALSE",
+	"COLLATE BINARY", `COLLATE "C"`,
+)
+
+func (db *DB) ddl(schema string) string {
+	if db.dialect != DialectPostgres {
+		return schema
+	}
+	return postgresTypes.Replace(schema)
+}
+
+// Explicit list for SELECTs, so the order matches scanFirmwareInfo
+// regardless of the order columns were added to the table in.
+const FIRMWARE_COLUMNS = `
+	    	firmwares.id,
+	    	firmwares.uuid,
+	    	firmwares.repoName,
+	    	firmwares.commitId,
+	    	firmwares.createdAt,
+	    	firmwares.createdBy,
+	    	firmwares.md5,
+	    	firmwares.description,
+	    	firmwares.size,
+	    	firmwares.channel,
+	    	firmwares.version,
+	    	firmwares.versionKey,
+	    	firmwares.sha256,
+	    	firmwares.signature,
+	    	firmwares.signatureKid,
+	    	firmwares.devSignature,
+	    	firmwares.devKid`
+
+// Opens database without checking its schema, see NewDB.
+func OpenDB(cfg *Config) (*DB, error) {
+	dsn := cfg.databaseDsn
+	if dsn == "" {
+		dsn = filepath.Join(cfg.storagePath, SQLITE_DB_FILENAME)
+	}
+
+	dialect := dialectOf(dsn)
+	if dialect == DialectSqlite {
+		// Params given in the DSN take precedence. Foreign keys are only enforced if
+		// enabled for each connection. Transactions take the write lock at once, so
+		// concurrent ones wait for busy timeout instead of failing on the first write.
+		if strings.Contains(dsn, "?") {
+			dsn += "&"
+		} else {
+			dsn += "?"
+		}
+		dsn += "_journal_mode=WAL&_busy_timeout=10000&_txlock=immediate&_foreign_keys=on"
+	}
+
+	_db, err := sql.Open(string(dialect), dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{_db, dialect}, nil
+}
+
+// Opens database and applies pending migrations, or only checks there are none
+// if database.autoMigrate is off.
+func NewDB(cfg *Config) (*DB, error) {
+	db, err := OpenDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.databaseAutoMigrate {
+		_, err = db.Migrate()
+	} else {
+		err = db.CheckSchemaVersion()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Adds firmware with its boards in one transaction.
+func (db *DB) AddFirmwareInfo(info *FirmwareInfo) (*FirmwareInfo, error) {
+	ret := *info
+	err := db.inTx(func(tx *Tx) error {
+		err := tx.QueryRow(`
+        INSERT INTO firmwares (
+            uuid,
+            repoName,
+            commitId,
+            createdAt,
+            createdBy,
+            md5,
+            description,
+            size,
+            channel,
+            version,
+            versionKey
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        RETURNING id`,
+			info.Uuid,
+			info.RepoName,
+			info.CommitId,
+			info.CreatedAt,
+			info.CreatedBy,
+			info.Md5,
+			info.Description,
+			info.Size,
+			info.Channel,
+			info.Version,
+			info.VersionKey,
+		).Scan(&ret.Id)
+		if isUniqueViolation(err) {
+			// Version was added meanwhile, see firmwaresRepoVersion index.
+			return &VersionAlreadyExistsError{info.Version}
+		}
+		if err != nil {
+			return err
+		}
+
+		stmt, err := tx.Prepare(`
+        INSERT INTO boards (
+            boardName,
+            firmwareId
+        ) VALUES (?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, board := range info.Boards {
+			if _, err := stmt.Exec(board, ret.Id); err != nil {
+				return err
+			}
+		}
+
+		// Created together, so boards outside the rollout never see the firmware.
+		if info.RolloutPercentage != nil {
+			_, err := tx.Exec(
+				"INSERT INTO rollouts (firmwareId, percentage, updatedAt, updatedBy) VALUES (?, ?, ?, ?)",
+				ret.Id,
+				*info.RolloutPercentage,
+				info.CreatedAt,
+				info.CreatedBy,
+			)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+func scanFirmwareInfo(rows *sql.Rows) (*FirmwareInfo, error) {
+	var fi FirmwareInfo
+	if err := rows.Scan(
+		&fi.Id,
+		&fi.Uuid,
+		&fi.RepoName,
+		&fi.CommitId,
+		&fi.CreatedAt,
+		&fi.CreatedBy,
+		&fi.Md5,
+		&fi.Description,
+		&fi.Size,
+		&fi.Channel,
+		&fi.Version,
+		&fi.VersionKey,
+		&fi.Sha256,
+		&fi.Signature,
+		&fi.SignatureKid,
+		&fi.DevSignature,
+		&fi.DevKid,
+	); err != nil {
+		return nil, err
+	}
+
+	return &fi, nil
+}
+
+// Runs query selecting FIRMWARE_COLUMNS, then loads boards and variants of all
+// the firmwares found.
+func (db *DB) queryFirmwareInfos(query string, args ...any) ([]FirmwareInfo, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fis []FirmwareInfo
+	for rows.Next() {
+		fi, err := scanFirmwareInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, *fi)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := db.loadFirmwareDetails(fis); err != nil {
+		return nil, err
+	}
+	return fis, nil
+}
+
+// Returns nil if query finds nothing.
+func (db *DB) queryFirmwareInfo(query string, args ...any) (*FirmwareInfo, error) {
+	fis, err := db.queryFirmwareInfos(query, args...)
+	if err != nil || len(fis) == 0 {
+		return nil, err
+	}
+	return &fis[0], nil
+}
+
+// Max number of firmwares boards and variants are loaded for with one query.
+const FIRMWARE_DETAILS_BATCH = 500
+
+// Fills in boards and variants with two queries per batch of firmwares.
+func (db *DB) loadFirmwareDetails(fis []FirmwareInfo) error {
+	for start := 0; start < len(fis); start += FIRMWARE_DETAILS_BATCH {
+		batch := fis[start:min(start+FIRMWARE_DETAILS_BATCH, len(fis))]
+
+		byId := make(map[int64]*FirmwareInfo, len(batch))
+		ids := make([]any, len(batch))
+		for i := range batch {
+			byId[batch[i].Id] = &batch[i]
+			ids[i] = batch[i].Id
+		}
+		in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+
+		boardRows, err := db.Query(
+			"SELECT firmwareId, boardName FROM boards WHERE firmwareId IN "+in+" ORDER BY boardName;",
+			ids...,
+		)
+		if err != nil {
+			return err
+		}
+		for boardRows.Next() {
+			var (
+				id    int64
+				board string
+			)
+			if err := boardRows.Scan(&id, &board); err != nil {
+				boardRows.Close()
+				return err
+			}
+			byId[id].Boards = append(byId[id].Boards, board)
+		}
+		boardRows.Close()
+		if err := boardRows.Err(); err != nil {
+			return err
+		}
+
+		variantRows, err := db.Query(
+			"SELECT firmwareId, encoding, size, sha256 FROM variants WHERE firmwareId IN "+in+" ORDER BY encoding;",
+			ids...,
+		)
+		if err != nil {
+			return err
+		}
+		for variantRows.Next() {
+			var v Variant
+			if err := variantRows.Scan(&v.FirmwareId, &v.Encoding, &v.Size, &v.Sha256); err != nil {
+				variantRows.Close()
+				return err
+			}
+			byId[v.FirmwareId].Variants = append(byId[v.FirmwareId].Variants, v)
+		}
+		variantRows.Close()
+		if err := variantRows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type RolloutCandidate struct {
+	Uuid       string
+	Percentage int
+}
+
+// Returns firmwares released to any of the given channels from the newest (by version)
+// down to the first one rolled out to all boards (or the oldest one).
+// Paused rollouts have zero percentage.
+func (db *DB) GetRolloutCandidates(repo string, board string, channels []Channel) ([]RolloutCandidate, error) {
+	args := []any{repo, board}
+	for _, ch := range channels {
+		args = append(args, ch)
+	}
+
+	stmt, err := db.Prepare(`
+        SELECT
+            firmwares.uuid,
+            CASE WHEN rollouts.paused THEN 0 ELSE COALESCE(rollouts.percentage, 100) END
+        FROM boards
+            JOIN firmwares ON firmwares.id = boards.firmwareId
+            LEFT JOIN rollouts ON rollouts.firmwareId = firmwares.id
+        WHERE
+            firmwares.repoName = ?
+            AND boards.boardName = ?
+            AND firmwares.size != 0
+            AND firmwares.channel IN (?` + strings.Repeat(", ?", len(channels)-1) + `)
+        ORDER BY firmwares.versionKey DESC, firmwares.createdAt DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rcs []RolloutCandidate
+	for rows.Next() {
+		var rc RolloutCandidate
+		if err := rows.Scan(&rc.Uuid, &rc.Percentage); err != nil {
+			return nil, err
+		}
+		rcs = append(rcs, rc)
+
+		if rc.Percentage == 100 {
+			break
+		}
+	}
+
+	return rcs, nil
+}
+
+func (db *DB) FirmwareVersionExists(repo string, versionKey string) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM firmwares WHERE repoName = ? AND versionKey = ?",
+		repo,
+		versionKey,
+	).Scan(&count)
+
+	return count != 0, err
+}
+
+func (db *DB) GetFirmareInfoByUuid(uuid string) (*FirmwareInfo, error) {
+	return db.queryFirmwareInfo("SELECT"+FIRMWARE_COLUMNS+" FROM firmwares WHERE uuid = ?", uuid)
+}
+
+// Returns nil if there is no firmware with such version in repo.
+func (db *DB) GetFirmwareInfoByVersion(repo string, versionKey string) (*FirmwareInfo, error) {
+	return db.queryFirmwareInfo(
+		"SELECT"+FIRMWARE_COLUMNS+" FROM firmwares WHERE repoName = ? AND versionKey = ?",
+		repo,
+		versionKey,
+	)
+}
+
+// Returns up to limit uploaded firmwares of the same repo with lower versions,
+// made for at least one of the boards of the given firmware, the newest first.
+func (db *DB) GetDeltaBases(fi *FirmwareInfo, limit int) ([]FirmwareInfo, error) {
+	return db.queryFirmwareInfos(`
+        SELECT`+FIRMWARE_COLUMNS+`
+        FROM firmwares
+        WHERE
+            firmwares.repoName = ?
+            AND firmwares.size != 0
+            AND firmwares.versionKey != ''
+            AND firmwares.versionKey < ?
+            AND firmwares.sha256 != ''
+            AND firmwares.id IN (
+                SELECT firmwareId FROM boards
+                WHERE boardName IN (SELECT boardName FROM boards WHERE firmwareId = ?)
+            )
+        ORDER BY firmwares.versionKey DESC
+        LIMIT ?;`,
+		fi.RepoName,
+		fi.VersionKey,
+		fi.Id,
+		limit,
+	)
+}
+
+func (db *DB) AddDelta(d *Delta) error {
+	stmt, err := db.Prepare(`
+    INSERT INTO deltas (
+        firmwareId,
+        baseFirmwareId,
+        size,
+        sha256,
+        createdAt
+    ) VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT (firmwareId, baseFirmwareId) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		d.FirmwareId,
+		d.BaseFirmwareId,
+		d.Size,
+		d.Sha256,
+		d.CreatedAt,
+	)
+	return err
+}
+
+// Returns nil if there is no such delta.
+func (db *DB) GetDelta(firmwareId int64, baseFirmwareId int64) (*Delta, error) {
+	var d Delta
+	err := db.QueryRow(`
+    SELECT id, firmwareId, baseFirmwareId, size, sha256, createdAt
+    FROM deltas WHERE firmwareId = ? AND baseFirmwareId = ?`, firmwareId, baseFirmwareId).Scan(
+		&d.Id,
+		&d.FirmwareId,
+		&d.BaseFirmwareId,
+		&d.Size,
+		&d.Sha256,
+		&d.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (db *DB) GetAllFirmwaresInfo() ([]FirmwareInfo, error) {
+	return db.queryFirmwareInfos(`
+        SELECT` + FIRMWARE_COLUMNS + `
+        FROM firmwares
+        ORDER BY firmwares.repoName, firmwares.versionKey DESC, firmwares.createdAt DESC;`)
+}
+
+// Returns up to limit firmwares matching the filter in the given order, starting
+// after the cursor if it's not nil.
+func (db *DB) ListFirmwaresInfo(filter *FirmwareFilter, sort FirmwareSort, after *FirmwareCursor, limit int) ([]FirmwareInfo, error) {
+	var (
+		conds []string
+		args  []any
+	)
+
+	if filter.Repos != nil {
+		if len(filter.Repos) == 0 {
+			return nil, nil
+		}
+		conds = append(conds, "firmwares.repoName IN (?"+strings.Repeat(", ?", len(filter.Repos)-1)+")")
+		for _, repo := range filter.Repos {
+			args = append(args, repo)
+		}
+	}
+	if filter.Board != "" {
+		conds = append(conds, "firmwares.id IN (SELECT firmwareId FROM boards WHERE boardName = ?)")
+		args = append(args, filter.Board)
+	}
+	if filter.CreatedBy != "" {
+		conds = append(conds, "firmwares.createdBy = ?")
+		args = append(args, filter.CreatedBy)
+	}
+	if filter.CommitPrefix != "" {
+		conds = append(conds, "substr(firmwares.commitId, 1, ?) = ?")
+		args = append(args, len(filter.CommitPrefix), filter.CommitPrefix)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		conds = append(conds, db.dialect.timestamp("firmwares.createdAt")+" >= "+db.dialect.timestamp("?"))
+		args = append(args, filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		conds = append(conds, db.dialect.timestamp("firmwares.createdAt")+" < "+db.dialect.timestamp("?"))
+		args = append(args, filter.CreatedBefore)
+	}
+	if filter.HasBinary != nil {
+		if *filter.HasBinary {
+			conds = append(conds, "firmwares.size != 0")
+		} else {
+			conds = append(conds, "firmwares.size = 0")
+		}
+	}
+
+	// Ids grow in order of creation, so they stand for createdAt and break ties.
+	var order string
+	switch sort {
+	case SortVersionAsc, SortVersionDesc:
+		dir, cmp := "DESC", "<"
+		if sort == SortVersionAsc {
+			dir, cmp = "ASC", ">"
+		}
+		order = "firmwares.repoName, firmwares.versionKey " + dir + ", firmwares.id " + dir
+		if after != nil {
+			conds = append(conds, fmt.Sprintf(
+				"(firmwares.repoName > ? OR (firmwares.repoName = ? AND (firmwares.versionKey %[1]s ? OR (firmwares.versionKey = ? AND firmwares.id %[1]s ?))))",
+				cmp,
+			))
+			args = append(args, after.RepoName, after.RepoName, after.VersionKey, after.VersionKey, after.Id)
+		}
+	default:
+		dir, cmp := "DESC", "<"
+		if sort == SortCreatedAsc {
+			dir, cmp = "ASC", ">"
+		}
+		order = "firmwares.id " + dir
+		if after != nil {
+			conds = append(conds, "firmwares.id "+cmp+" ?")
+			args = append(args, after.Id)
+		}
+	}
+
+	where := ""
+	if len(conds) != 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, limit)
+
+	return db.queryFirmwareInfos(`
+        SELECT`+FIRMWARE_COLUMNS+`
+        FROM firmwares
+        `+where+`
+        ORDER BY `+order+`
+        LIMIT ?;`,
+		args...,
+	)
+}
+
+// Updates digests and signatures of the uploaded binary and adds its variants
+// in one transaction. Returns FirmwareFileAlreadyUploaded if the firmware already
+// has a binary, e.g. added by another server.
+func (db *DB) UpdateFirmwareFileInfo(fi *FirmwareInfo) error {
+	return db.inTx(func(tx *Tx) error {
+		res, err := tx.Exec(`
+        UPDATE firmwares
+        SET
+            md5 = ?,
+            sha256 = ?,
+            size = ?,
+            signature = ?,
+            signatureKid = ?,
+            devSignature = ?,
+            devKid = ?
+        WHERE firmwares.id = ? AND firmwares.size = 0`,
+			fi.Md5,
+			fi.Sha256,
+			fi.Size,
+			fi.Signature,
+			fi.SignatureKid,
+			fi.DevSignature,
+			fi.DevKid,
+			fi.Id,
+		)
+		if err != nil {
+			return err
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return &FirmwareFileAlreadyUploaded{}
+		}
+
+		stmt, err := tx.Prepare(`
+        INSERT INTO variants (
+            firmwareId,
+            encoding,
+            size,
+            sha256
+        ) VALUES (?, ?, ?, ?)
+        ON CONFLICT (firmwareId, encoding) DO UPDATE SET
+            size = excluded.size,
+            sha256 = excluded.sha256`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, v := range fi.Variants {
+			if _, err := stmt.Exec(v.FirmwareId, v.Encoding, v.Size, v.Sha256); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *DB) SetFirmwareSha256(firmwareId int64, sha256 string) error {
+	_, err := db.Exec("UPDATE firmwares SET sha256 = ? WHERE id = ?", sha256, firmwareId)
+	return err
+}
+
+// Adds a reference to the blob, returns number of references.
+func (db *DB) AcquireBlob(sha256 string, size int64) (int64, error) {
+	var refs int64
+	err := db.QueryRow(`
+    INSERT INTO blobs (sha256, size, refCount) VALUES (?, ?, 1)
+    ON CONFLICT (sha256) DO UPDATE SET refCount = blobs.refCount + 1
+    RETURNING refCount`, sha256, size).Scan(&refs)
+	return refs, err
+}
+
+// Removes a reference to the blob, returns number of references left.
+// The blob record is removed with the last reference.
+func (db *DB) ReleaseBlob(sha256 string) (int64, error) {
+	var refs int64
+	err := db.inTx(func(tx *Tx) error {
+		err := tx.QueryRow(`
+        UPDATE blobs SET refCount = refCount - 1 WHERE sha256 = ?
+        RETURNING refCount`, sha256).Scan(&refs)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil || refs > 0 {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM blobs WHERE sha256 = ?", sha256)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return refs, nil
+}
+
+func (db *DB) AddTokenRecord(tr *TokenRecord) (*TokenRecord, error) {
+	stmt, err := db.Prepare(`
+    INSERT INTO tokens (
+        jti,
+        subject,
+        scope,
+        issuedAt,
+        expiresAt
+    ) VALUES (?, ?, ?, ?, ?)
+    RETURNING id`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	ret := *tr
+	err = stmt.QueryRow(
+		tr.Jti,
+		tr.Subject,
+		tr.Scope,
+		tr.IssuedAt,
+		tr.ExpiresAt,
+	).Scan(&ret.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+func tokenRecordFromSqlRows(rows *sql.Rows) (*TokenRecord, error) {
+	var tr TokenRecord
+	if err := rows.Scan(
+		&tr.Id,
+		&tr.Jti,
+		&tr.Subject,
+		&tr.Scope,
+		&tr.IssuedAt,
+		&tr.ExpiresAt,
+		&tr.RevokedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	return &tr, nil
+}
+
+func (db *DB) GetTokenRecordByJti(jti string) (*TokenRecord, error) {
+	stmt, err := db.Prepare("SELECT * FROM tokens WHERE jti = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(jti)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, nil
+	}
+
+	return tokenRecordFromSqlRows(rows)
+}
+
+func (db *DB) GetAllTokenRecords() ([]TokenRecord, error) {
+	stmt, err := db.Prepare("SELECT * FROM tokens ORDER BY issuedAt;")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trs []TokenRecord
+	for rows.Next() {
+		tr, err := tokenRecordFromSqlRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		trs = append(trs, *tr)
+	}
+
+	return trs, nil
 }
 
-const SQLITE_DB_FILENAME = "firmware.db"
+// Returns false if there is no active token with given jti.
+func (db *DB) RevokeToken(jti string, revokedAt time.Time) (bool, error) {
+	stmt, err := db.Prepare(`
+    UPDATE tokens
+    SET revokedAt = ?
+    WHERE jti = ? AND revokedAt IS NULL
+    `)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
 
-func (db *DB) createTables() error {
-	db.Lock()
-	defer db.Unlock()
-
-	_, err := db.Exec(`
-	CREATE TABLE IF NOT EXISTS firmwares (
-	    id          INTEGER PRIMARY KEY AUTOINCREMENT,
-        uuid        TEXT UNIQUE NOT NULL,
-	    repoName    TEXT NOT NULL,
-	    commitId    TEXT NOT NULL,
-	    createdAt   DATETIME NOT NULL,
-	    createdBy   TEXT NOT NULL,
-        md5         TEXT NOT NULL,
-        description TEXT NOT NULL,
-        size        INTEGER NOT NULL
-	);
-    CREATE TABLE IF NOT EXISTS boards (
-        boardName   TEXT NOT NULL,
-        firmwareId  INTEGER NOT NULL
-    );`)
+	result, err := stmt.Exec(revokedAt, jti)
+	if err != nil {
+		return false, err
+	}
 
-	return err
+	n, err := result.RowsAffected()
+	return n != 0, err
 }
 
-func NewDB(cfg *Config) (*DB, error) {
-	path := filepath.Join(cfg.storagePath, SQLITE_DB_FILENAME)
-	_db, err := sql.Open("sqlite3", path)
+func (db *DB) AddSigningKeyRecord(kr *SigningKeyRecord) (*SigningKeyRecord, error) {
+	stmt, err := db.Prepare(`
+    INSERT INTO signing_keys (
+        kid,
+        alg,
+        createdAt
+    ) VALUES (?, ?, ?)
+    RETURNING id`)
 	if err != nil {
 		return nil, err
 	}
+	defer stmt.Close()
 
-	db := &DB{_db, sync.Mutex{}}
-	err = db.createTables()
+	ret := *kr
+	err = stmt.QueryRow(
+		kr.Kid,
+		kr.Alg,
+		kr.CreatedAt,
+	).Scan(&ret.Id)
+	if err != nil {
+		return nil, err
+	}
 
-	return db, err
+	return &ret, nil
 }
 
-func (db *DB) AddFirmwareInfo(info *FirmwareInfo) (*FirmwareInfo, error) {
-	db.Lock()
-	defer db.Unlock()
+func signingKeyRecordFromSqlRows(rows *sql.Rows) (*SigningKeyRecord, error) {
+	var kr SigningKeyRecord
+	if err := rows.Scan(
+		&kr.Id,
+		&kr.Kid,
+		&kr.Alg,
+		&kr.CreatedAt,
+		&kr.RetiresAt,
+	); err != nil {
+		return nil, err
+	}
 
-	stmt, err := db.Prepare(`
-    INSERT INTO firmwares (
-        uuid,
-        repoName,
-        commitId,
-        createdAt,
-        createdBy,
-        md5,
-        description,
-        size
-    ) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	return &kr, nil
+}
+
+func (db *DB) querySigningKeyRecord(query string, args ...any) (*SigningKeyRecord, error) {
+	stmt, err := db.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(
-        info.Uuid,
-		info.RepoName,
-		info.CommitId,
-		info.CreatedAt,
-		info.CreatedBy,
-		info.Md5,
-		info.Description,
-		info.Size,
-	)
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	ret := *info
-	ret.Id, err = result.LastInsertId()
+	if !rows.Next() {
+		return nil, nil
+	}
+
+	return signingKeyRecordFromSqlRows(rows)
+}
+
+func (db *DB) GetSigningKeyRecordByKid(kid string) (*SigningKeyRecord, error) {
+	return db.querySigningKeyRecord("SELECT * FROM signing_keys WHERE kid = ?", kid)
+}
+
+func (db *DB) GetActiveSigningKeyRecord() (*SigningKeyRecord, error) {
+	return db.querySigningKeyRecord(`
+        SELECT * FROM signing_keys
+        WHERE retiresAt IS NULL
+        ORDER BY createdAt DESC LIMIT 1`)
+}
+
+func (db *DB) GetAllSigningKeyRecords() ([]SigningKeyRecord, error) {
+	stmt, err := db.Prepare("SELECT * FROM signing_keys ORDER BY createdAt;")
 	if err != nil {
 		return nil, err
 	}
+	defer stmt.Close()
 
-	stmt2, err := db.Prepare(`
-    INSERT INTO boards (
-        boardName,
-        firmwareId
-    ) VALUES (?, ?)
-    `)
+	rows, err := stmt.Query()
 	if err != nil {
 		return nil, err
 	}
-	defer stmt2.Close()
+	defer rows.Close()
 
-	for _, board := range info.Boards {
-		_, err := stmt2.Exec(
-			board,
-			ret.Id,
-		)
+	var krs []SigningKeyRecord
+	for rows.Next() {
+		kr, err := signingKeyRecordFromSqlRows(rows)
 		if err != nil {
 			return nil, err
 		}
+		krs = append(krs, *kr)
 	}
 
-	return &ret, nil
+	return krs, nil
 }
 
-func (db *DB) firmwareInfoFromSqlRows(firmwareRows *sql.Rows) (*FirmwareInfo, error) {
-	var fi FirmwareInfo
-	if err := firmwareRows.Scan(
-		&fi.Id,
-        &fi.Uuid,
-		&fi.RepoName,
-		&fi.CommitId,
-		&fi.CreatedAt,
-		&fi.CreatedBy,
-		&fi.Md5,
-		&fi.Description,
-		&fi.Size,
-	); err != nil {
+// Schedules retirement of all active keys except the given one.
+func (db *DB) RetireSigningKeys(exceptKid string, retiresAt time.Time) error {
+	stmt, err := db.Prepare(`
+    UPDATE signing_keys
+    SET retiresAt = ?
+    WHERE retiresAt IS NULL AND kid != ?
+    `)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(retiresAt, exceptKid)
+	return err
+}
+
+func (db *DB) AddDeveloperKeyRecord(kr *DeveloperKeyRecord) (*DeveloperKeyRecord, error) {
+	stmt, err := db.Prepare(`
+    INSERT INTO developer_keys (
+        kid,
+        subject,
+        alg,
+        publicKey,
+        createdAt
+    ) VALUES (?, ?, ?, ?, ?)
+    RETURNING id`)
+	if err != nil {
 		return nil, err
 	}
+	defer stmt.Close()
+
+	ret := *kr
+	err = stmt.QueryRow(
+		kr.Kid,
+		kr.Subject,
+		kr.Alg,
+		kr.PublicKey,
+		kr.CreatedAt,
+	).Scan(&ret.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
 
-	stmt, err := db.Prepare("SELECT boardName FROM boards where firmwareId = ?;")
+func (db *DB) DeveloperKeyExists(kid string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM developer_keys WHERE kid = ?", kid).Scan(&count)
+	return count != 0, err
+}
+
+func (db *DB) queryDeveloperKeyRecords(query string, args ...any) ([]DeveloperKeyRecord, error) {
+	stmt, err := db.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	boardRows, err := stmt.Query(fi.Id)
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		return nil, err
 	}
-	defer boardRows.Close()
+	defer rows.Close()
 
-	for boardRows.Next() {
-		var board string
-		if err := boardRows.Scan(&board); err != nil {
+	var krs []DeveloperKeyRecord
+	for rows.Next() {
+		var kr DeveloperKeyRecord
+		if err := rows.Scan(
+			&kr.Id,
+			&kr.Kid,
+			&kr.Subject,
+			&kr.Alg,
+			&kr.PublicKey,
+			&kr.CreatedAt,
+			&kr.RevokedAt,
+		); err != nil {
 			return nil, err
 		}
-		fi.Boards = append(fi.Boards, board)
+		krs = append(krs, kr)
 	}
 
-	return &fi, nil
+	return krs, nil
+}
+
+// Returns not revoked keys of the subject.
+func (db *DB) GetActiveDeveloperKeyRecords(subject string) ([]DeveloperKeyRecord, error) {
+	return db.queryDeveloperKeyRecords(`
+        SELECT * FROM developer_keys
+        WHERE subject = ? AND revokedAt IS NULL
+        ORDER BY createdAt`, subject)
 }
 
-func (db *DB) GetLatestFirmwareInfo(repo string, board string) (*FirmwareInfo, error) {
-	db.Lock()
-	defer db.Unlock()
+func (db *DB) GetAllDeveloperKeyRecords() ([]DeveloperKeyRecord, error) {
+	return db.queryDeveloperKeyRecords("SELECT * FROM developer_keys ORDER BY subject, createdAt")
+}
 
+// Returns false if there is no active key with given kid.
+func (db *DB) RevokeDeveloperKey(kid string, revokedAt time.Time) (bool, error) {
 	stmt, err := db.Prepare(`
-        SELECT
-	    	firmwares.id,
-	    	firmwares.uuid,
-	    	firmwares.repoName,
-	    	firmwares.commitId,
-	    	firmwares.createdAt,
-	    	firmwares.createdBy,
-	    	firmwares.md5,
-	    	firmwares.description,
-	    	firmwares.size
-        FROM boards JOIN firmwares ON firmwares.id = boards.firmwareId
-        WHERE
-            firmwares.repoName = ?
-            AND boards.boardName = ?
-            AND firmwares.size != 0
-        ORDER BY firmwares.createdAt DESC LIMIT 1;`)
+    UPDATE developer_keys
+    SET revokedAt = ?
+    WHERE kid = ? AND revokedAt IS NULL
+    `)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(revokedAt, kid)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n != 0, err
+}
+
+// Inserts device or replaces its last reported state for the repo.
+func (db *DB) UpsertDeviceInfo(di *DeviceInfo) error {
+	stmt, err := db.Prepare(`
+    INSERT INTO devices (
+        name,
+        repoName,
+        firmwareUuid,
+        commitId,
+        uptime,
+        resetReason,
+        lastCheckinAt
+    ) VALUES (?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT(name, repoName) DO UPDATE SET
+        firmwareUuid = excluded.firmwareUuid,
+        commitId = excluded.commitId,
+        uptime = excluded.uptime,
+        resetReason = excluded.resetReason,
+        lastCheckinAt = excluded.lastCheckinAt`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		di.Name,
+		di.RepoName,
+		di.FirmwareUuid,
+		di.CommitId,
+		di.Uptime,
+		di.ResetReason,
+		di.LastCheckinAt,
+	)
+	return err
+}
+
+func (db *DB) GetAllDevicesInfo() ([]DeviceInfo, error) {
+	stmt, err := db.Prepare("SELECT * FROM devices ORDER BY name, repoName;")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(repo, board)
+	rows, err := stmt.Query()
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	if !rows.Next() {
-		return nil, nil
+	var dis []DeviceInfo
+	for rows.Next() {
+		var di DeviceInfo
+		if err := rows.Scan(
+			&di.Id,
+			&di.Name,
+			&di.RepoName,
+			&di.FirmwareUuid,
+			&di.CommitId,
+			&di.Uptime,
+			&di.ResetReason,
+			&di.LastCheckinAt,
+		); err != nil {
+			return nil, err
+		}
+		dis = append(dis, di)
 	}
 
-	return db.firmwareInfoFromSqlRows(rows)
+	return dis, nil
 }
 
-func (db *DB) GetFirmareInfoByUuid(uuid string) (*FirmwareInfo, error) {
-	db.Lock()
-	defer db.Unlock()
+func (db *DB) AddUpdateEvent(ue *UpdateEvent) (*UpdateEvent, error) {
+	stmt, err := db.Prepare(`
+    INSERT INTO update_events (
+        firmwareId,
+        deviceName,
+        status,
+        errorCode,
+        createdAt
+    ) VALUES (?, ?, ?, ?, ?)
+    RETURNING id`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
 
-	stmt, err := db.Prepare("SELECT * FROM firmwares WHERE uuid=?")
+	ret := *ue
+	err = stmt.QueryRow(
+		ue.FirmwareId,
+		ue.DeviceName,
+		ue.Status,
+		ue.ErrorCode,
+		ue.CreatedAt,
+	).Scan(&ret.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+// Returns 0 if no events were reported for the firmware.
+func (db *DB) GetLastUpdateEventId(firmwareId int64) (int64, error) {
+	var id int64
+	err := db.QueryRow(
+		"SELECT COALESCE(MAX(id), 0) FROM update_events WHERE firmwareId = ?",
+		firmwareId,
+	).Scan(&id)
+	return id, err
+}
+
+// Only events with ids greater than afterEvent are considered.
+func (db *DB) GetUpdateStats(firmwareId int64, afterEvent int64) (*UpdateStats, error) {
+	stmt, err := db.Prepare(`
+        SELECT update_events.status, update_events.errorCode, COUNT(*)
+        FROM update_events JOIN (
+            SELECT MAX(id) AS id FROM update_events
+            WHERE firmwareId = ? AND id > ?
+            GROUP BY deviceName
+        ) AS latest ON latest.id = update_events.id
+        GROUP BY update_events.status, update_events.errorCode;`)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(uuid)
+	rows, err := stmt.Query(firmwareId, afterEvent)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	if !rows.Next() {
-		return nil, nil
+	stats := UpdateStats{
+		ByStatus:   map[UpdateStatus]int{},
+		ErrorCodes: map[string]int{},
+	}
+	for rows.Next() {
+		var (
+			status    UpdateStatus
+			errorCode string
+			count     int
+		)
+		if err := rows.Scan(&status, &errorCode, &count); err != nil {
+			return nil, err
+		}
+
+		stats.Devices += count
+		stats.ByStatus[status] += count
+		if status == UpdateFailed {
+			stats.ErrorCodes[errorCode] += count
+		}
 	}
 
-	return db.firmwareInfoFromSqlRows(rows)
+	return &stats, nil
 }
 
-func (db *DB) GetAllFirmwaresInfo() ([]FirmwareInfo, error) {
-	db.Lock()
-	defer db.Unlock()
+func (db *DB) SetBoardSubscription(sub *BoardSubscription) error {
+	stmt, err := db.Prepare(`
+    INSERT INTO subscriptions (
+        boardName,
+        repoName,
+        channel
+    ) VALUES (?, ?, ?)
+    ON CONFLICT(boardName, repoName) DO UPDATE SET
+        channel = excluded.channel`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		sub.BoardName,
+		sub.RepoName,
+		sub.Channel,
+	)
+	return err
+}
 
-	stmt, err := db.Prepare("SELECT * FROM firmwares;")
+// Returns nil if board is not subscribed to any channel of the repo.
+func (db *DB) GetBoardSubscription(board string, repo string) (*BoardSubscription, error) {
+	sub := BoardSubscription{BoardName: board, RepoName: repo}
+	err := db.QueryRow(
+		"SELECT channel FROM subscriptions WHERE boardName = ? AND repoName = ?",
+		board,
+		repo,
+	).Scan(&sub.Channel)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &sub, nil
+}
+
+func (db *DB) GetBoardSubscriptions(board string) ([]BoardSubscription, error) {
+	stmt, err := db.Prepare(`
+        SELECT boardName, repoName, channel FROM subscriptions
+        WHERE boardName = ?
+        ORDER BY repoName;`)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query()
+	rows, err := stmt.Query(board)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var fis []FirmwareInfo
+	var subs []BoardSubscription
 	for rows.Next() {
-		fi, err := db.firmwareInfoFromSqlRows(rows)
-		if err != nil {
+		var sub BoardSubscription
+		if err := rows.Scan(&sub.BoardName, &sub.RepoName, &sub.Channel); err != nil {
 			return nil, err
 		}
-		fis = append(fis, *fi)
+		subs = append(subs, sub)
 	}
 
-	return fis, nil
+	return subs, nil
 }
 
-func (db *DB) UpdateFirmwareFileInfo(fi *FirmwareInfo) error {
-	db.Lock()
-	defer db.Unlock()
+func (db *DB) SetRollout(r *Rollout) error {
+	stmt, err := db.Prepare(`
+    INSERT INTO rollouts (
+        firmwareId,
+        percentage,
+        updatedAt,
+        updatedBy,
+        paused,
+        pauseReason,
+        pausedAt,
+        resumedAt,
+        resumedAfterEvent
+    ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT(firmwareId) DO UPDATE SET
+        percentage = excluded.percentage,
+        updatedAt = excluded.updatedAt,
+        updatedBy = excluded.updatedBy,
+        paused = excluded.paused,
+        pauseReason = excluded.pauseReason,
+        pausedAt = excluded.pausedAt,
+        resumedAt = excluded.resumedAt,
+        resumedAfterEvent = excluded.resumedAfterEvent`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		r.FirmwareId,
+		r.Percentage,
+		r.UpdatedAt,
+		r.UpdatedBy,
+		r.Paused,
+		r.PauseReason,
+		r.PausedAt,
+		r.ResumedAt,
+		r.ResumedAfterEvent,
+	)
+	return err
+}
+
+// Returns nil if there is no rollout record for the firmware.
+func (db *DB) GetRollout(firmwareId int64) (*Rollout, error) {
+	r := Rollout{FirmwareId: firmwareId}
+	err := db.QueryRow(
+		`SELECT percentage, updatedAt, updatedBy, paused, pauseReason, pausedAt, resumedAt, resumedAfterEvent
+        FROM rollouts WHERE firmwareId = ?`,
+		firmwareId,
+	).Scan(
+		&r.Percentage,
+		&r.UpdatedAt,
+		&r.UpdatedBy,
+		&r.Paused,
+		&r.PauseReason,
+		&r.PausedAt,
+		&r.ResumedAt,
+		&r.ResumedAfterEvent,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	return &r, nil
+}
+
+func (db *DB) AddUploadSession(us *UploadSession) error {
 	stmt, err := db.Prepare(`
-    UPDATE firmwares
-    SET
-        md5 = ?,
-        size = ?
-    WHERE firmwares.id = ?
-    `)
+    INSERT INTO uploads (
+        id,
+        firmwareId,
+        size,
+        md5,
+        createdBy,
+        createdAt,
+        sha256
+    ) VALUES (?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
 	_, err = stmt.Exec(
-		fi.Md5,
-		fi.Size,
-		fi.Id,
+		us.Id,
+		us.FirmwareId,
+		us.Size,
+		us.Md5,
+		us.CreatedBy,
+		us.CreatedAt,
+		us.Sha256,
+	)
+	return err
+}
+
+// Returns nil if there is no such session.
+func (db *DB) GetUploadSession(id string) (*UploadSession, error) {
+	var us UploadSession
+	err := db.QueryRow(`
+    SELECT id, firmwareId, size, md5, createdBy, createdAt, sha256
+    FROM uploads WHERE id = ?`, id).Scan(
+		&us.Id,
+		&us.FirmwareId,
+		&us.Size,
+		&us.Md5,
+		&us.CreatedBy,
+		&us.CreatedAt,
+		&us.Sha256,
 	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &us, nil
+}
+
+func (db *DB) GetUploadSessionsCreatedBefore(t time.Time) ([]UploadSession, error) {
+	rows, err := db.Query(`
+    SELECT id, firmwareId, size, md5, createdBy, createdAt, sha256
+    FROM uploads WHERE `+db.dialect.timestamp("createdAt")+" < "+db.dialect.timestamp("?"), t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []UploadSession
+	for rows.Next() {
+		var us UploadSession
+		err := rows.Scan(
+			&us.Id,
+			&us.FirmwareId,
+			&us.Size,
+			&us.Md5,
+			&us.CreatedBy,
+			&us.CreatedAt,
+			&us.Sha256,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, us)
+	}
+	return ret, rows.Err()
+}
+
+func (db *DB) DeleteUploadSession(id string) error {
+	_, err := db.Exec("DELETE FROM uploads WHERE id = ?", id)
 	return err
 }
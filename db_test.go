@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := NewDB(&Config{storagePath: t.TempDir(), databaseAutoMigrate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// The version may be added between CreateFirmware's check and the insert.
+func TestAddFirmwareInfoDuplicateVersion(t *testing.T) {
+	db := newTestDB(t)
+
+	fi := FirmwareInfo{
+		Uuid:       "first",
+		RepoName:   "repo",
+		Boards:     []string{"board"},
+		CreatedAt:  time.Now(),
+		Channel:    ChannelStable,
+		Version:    "1.0.0",
+		VersionKey: versionKey(t, "1.0.0"),
+	}
+	if _, err := db.AddFirmwareInfo(&fi); err != nil {
+		t.Fatal(err)
+	}
+
+	fi.Uuid = "second"
+	fi.Version = "1.0.0+build.2"
+	_, err := db.AddFirmwareInfo(&fi)
+	if _, ok := err.(*VersionAlreadyExistsError); !ok {
+		t.Fatalf("AddFirmwareInfo() error = %v, want VersionAlreadyExistsError", err)
+	}
+
+	if got, err := db.GetFirmareInfoByUuid("second"); err != nil || got != nil {
+		t.Errorf("duplicate firmware was added: %v, %v", got, err)
+	}
+}
+
+func TestUpsertDeviceInfoPerRepo(t *testing.T) {
+	db := newTestDB(t)
+	checkin := func(repo string, uuid string) {
+		t.Helper()
+		if err := db.UpsertDeviceInfo(&DeviceInfo{
+			Name:          "board",
+			RepoName:      repo,
+			FirmwareUuid:  uuid,
+			LastCheckinAt: time.Now(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkin("repoA", "a1")
+	checkin("repoB", "b1")
+	checkin("repoA", "a2")
+
+	dis, err := db.GetAllDevicesInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dis) != 2 ||
+		dis[0].RepoName != "repoA" || dis[0].FirmwareUuid != "a2" ||
+		dis[1].RepoName != "repoB" || dis[1].FirmwareUuid != "b1" {
+		t.Errorf("GetAllDevicesInfo() = %+v, want board in repoA with a2 and in repoB with b1", dis)
+	}
+}
+
+func TestDialectOf(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want Dialect
+	}{
+		{"postgres://ota:secret@db:5432/ota?sslmode=disable", DialectPostgres},
+		{"postgresql://db/ota", DialectPostgres},
+		{"host=db dbname=ota user=ota sslmode=disable", DialectPostgres},
+		{"  dbname = ota host=/var/run/postgresql", DialectPostgres},
+		{"sslmode=require host=db", DialectPostgres},
+		{"/var/lib/ota/firmware.db", DialectSqlite},
+		{"firmware.db", DialectSqlite},
+		{"file:firmware.db?cache=shared", DialectSqlite},
+		{"data/host=db.sqlite", DialectSqlite},
+	}
+	for _, tt := range tests {
+		if got := dialectOf(tt.dsn); got != tt.want {
+			t.Errorf("dialectOf(%q) = %s, want %s", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT id FROM firmwares WHERE repoName = ? AND versionKey > ? LIMIT ?"
+	if got := DialectSqlite.rebind(query); got != query {
+		t.Errorf("SQLite rebind() = %s", got)
+	}
+	want := "SELECT id FROM firmwares WHERE repoName = $1 AND versionKey > $2 LIMIT $3"
+	if got := DialectPostgres.rebind(query); got != want {
+		t.Errorf("PostgreSQL rebind() = %s\nwant %s", got, want)
+	}
+	if got := DialectPostgres.rebind("SELECT 1"); got != "SELECT 1" {
+		t.Errorf("PostgreSQL rebind() without params = %s", got)
+	}
+}
+
+func TestDdl(t *testing.T) {
+	schema := `CREATE TABLE t (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    n INTEGER NOT NULL,
+    createdAt DATETIME NOT NULL,
+    paused BOOLEAN NOT NULL DEFAULT 0,
+    versionKey TEXT COLLATE BINARY
+)`
+	want := `CREATE TABLE t (
+    id BIGSERIAL PRIMARY KEY,
+    n BIGINT NOT NULL,
+    createdAt TIMESTAMPTZ NOT NULL,
+    paused BOOLEAN NOT NULL DEFAULT FALSE,
+    versionKey TEXT COLLATE "C"
+)`
+	if got := (&DB{dialect: DialectSqlite}).ddl(schema); got != schema {
+		t.Errorf("SQLite ddl() = %s", got)
+	}
+	if got := (&DB{dialect: DialectPostgres}).ddl(schema); got != want {
+		t.Errorf("PostgreSQL ddl() = %s\nwant %s", got, want)
+	}
+}
+
+// Types only SQLite understands are all replaced in the migrations.
+func TestMigrationsDdl(t *testing.T) {
+	ms, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &DB{dialect: DialectPostgres}
+	for _, m := range ms {
+		ddl := db.ddl(m.sql)
+		for _, sqliteOnly := range []string{"AUTOINCREMENT", "DATETIME", "COLLATE BINARY", "BOOLEAN NOT NULL DEFAULT 0"} {
+			if strings.Contains(ddl, sqliteOnly) {
+				t.Errorf("migration %d has %s for PostgreSQL", m.Version, sqliteOnly)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Patches from previous versions are generated in background after a binary is uploaded,
+// one firmware at a time, as bsdiff takes a while and a lot of memory for large images
+// (about 20 times the size of the previous one), binaries over delta.maxSize are skipped.
+
+// Firmwares waiting for patches, uploads beyond that get none.
+const DELTA_QUEUE_SIZE = 100
+
+type DeltaService struct {
+	cfg  *Config
+	db   Store
+	bins *BinariesService
+
+	queue chan FirmwareInfo
+}
+
+// Starts the worker generating patches.
+func NewDeltaService(cfg *Config, db Store, bins *BinariesService) *DeltaService {
+	svc := &DeltaService{
+		cfg:   cfg,
+		db:    db,
+		bins:  bins,
+		queue: make(chan FirmwareInfo, DELTA_QUEUE_SIZE),
+	}
+	go svc.work()
+	return svc
+}
+
+func (svc *DeltaService) work() {
+	for fi := range svc.queue {
+		if err := svc.generate(&fi); err != nil {
+			log.Printf("failed to generate deltas for firmware %s: %v", fi.Uuid, err)
+		}
+	}
+}
+
+// Queues generation of patches to the firmware from delta.baseVersions previous versions.
+func (svc *DeltaService) GenerateAsync(fi FirmwareInfo) {
+	if svc.cfg.deltaBaseVersions <= 0 || fi.VersionKey == "" || fi.Size > svc.cfg.deltaMaxSize {
+		return
+	}
+
+	select {
+	case svc.queue <- fi:
+	default:
+		log.Printf("delta queue is full, no patches for firmware %s", fi.Uuid)
+	}
+}
+
+func (svc *DeltaService) generate(fi *FirmwareInfo) error {
+	bases, err := svc.db.GetDeltaBases(fi, svc.cfg.deltaBaseVersions)
+	if err != nil || len(bases) == 0 {
+		return err
+	}
+
+	new, err := svc.bins.Read(svc.bins.GetBinaryFile(fi))
+	if err != nil {
+		return err
+	}
+
+	for _, base := range bases {
+		if base.Size > svc.cfg.deltaMaxSize {
+			continue
+		}
+
+		old, err := svc.bins.Read(svc.bins.GetBinaryFile(&base))
+		if err != nil {
+			return err
+		}
+
+		patch := bsdiff(old, new)
+		if len(patch) >= len(new) {
+			// Full image is cheaper to download.
+			continue
+		}
+
+		// Boards can't recover from a bad patch as easily as the server.
+		if check, err := bspatch(old, patch); err != nil || !bytes.Equal(check, new) {
+			return fmt.Errorf("patch from %s doesn't reproduce the binary", base.Uuid)
+		}
+
+		d := &Delta{
+			FirmwareId:     fi.Id,
+			BaseFirmwareId: base.Id,
+			Size:           int64(len(patch)),
+			Sha256:         fmt.Sprintf("%x", sha256.Sum256(patch)),
+			CreatedAt:      time.Now(),
+		}
+		if err := svc.bins.WriteDelta(fi, &base, d, patch); err != nil {
+			return err
+		}
+		if err := svc.db.AddDelta(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns nil if there is no patch from base to the firmware (yet).
+func (svc *DeltaService) Get(fi *FirmwareInfo, base *FirmwareInfo) (*Delta, error) {
+	return svc.db.GetDelta(fi.Id, base.Id)
+}
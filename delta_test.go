@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Stores the binary and records it for the firmware added without one.
+func addTestBinary(t *testing.T, svc *FirmwareService, fi *FirmwareInfo, data []byte) {
+	t.Helper()
+	sb, err := svc.bins.Stage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.bins.Discard(sb)
+
+	if err := svc.bins.Commit(sb); err != nil {
+		t.Fatal(err)
+	}
+	fi.Md5, fi.Sha256, fi.Size = sb.Md5, sb.Sha256, int(sb.Size)
+	if err := svc.db.UpdateFirmwareFileInfo(fi); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addTestFirmwareWithBinary(t *testing.T, svc *FirmwareService, version string, data []byte) *FirmwareInfo {
+	t.Helper()
+	fi, err := svc.db.AddFirmwareInfo(newTestFirmwareInfo(t, "repo", version, []string{"board"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestBinary(t, svc, fi, data)
+	return fi
+}
+
+func TestGenerateDeltas(t *testing.T) {
+	svc := newTestFirmwareService(t)
+	svc.cfg.deltaBaseVersions = 3
+	svc.cfg.deltaMaxSize = 64 * 1024
+	deltas := &DeltaService{cfg: svc.cfg, db: svc.db, bins: svc.bins}
+
+	r := rand.New(rand.NewSource(1))
+	image := randomBytes(r, 32*1024)
+	v1 := addTestFirmwareWithBinary(t, svc, "1.0.0", image)
+	large := addTestFirmwareWithBinary(t, svc, "1.1.0", randomBytes(r, 100*1024))
+	image = editBytes(r, image)
+	v2 := addTestFirmwareWithBinary(t, svc, "1.2.0", image)
+
+	if err := deltas.generate(v2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The base over delta.maxSize is skipped.
+	if d, err := deltas.Get(v2, large); err != nil || d != nil {
+		t.Errorf("delta from the large binary: %+v, %v", d, err)
+	}
+
+	d, err := deltas.Get(v2, v1)
+	if err != nil || d == nil {
+		t.Fatalf("no delta from %s: %v", v1.Version, err)
+	}
+	old, err := svc.bins.Read(svc.bins.GetBinaryFile(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := svc.bins.Read(svc.bins.GetDeltaFile(v2, v1, d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bspatch(old, patch); err != nil || !bytes.Equal(got, image) {
+		t.Errorf("stored patch doesn't reproduce the binary: %v", err)
+	}
+}
+
+func TestGenerateAsyncQueue(t *testing.T) {
+	cfg := &Config{deltaBaseVersions: 3, deltaMaxSize: 1024}
+	// No worker, so the queue stays full.
+	deltas := &DeltaService{cfg: cfg, queue: make(chan FirmwareInfo, 1)}
+
+	deltas.GenerateAsync(FirmwareInfo{Uuid: "large", VersionKey: "v", Size: 2048})
+	deltas.GenerateAsync(FirmwareInfo{Uuid: "first", VersionKey: "v", Size: 1024})
+
+	done := make(chan struct{})
+	go func() {
+		deltas.GenerateAsync(FirmwareInfo{Uuid: "second", VersionKey: "v", Size: 1024})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("GenerateAsync() blocks on the full queue")
+	}
+
+	if fi := <-deltas.queue; fi.Uuid != "first" || len(deltas.queue) != 0 {
+		t.Errorf("queued %s and %d more, want only first", fi.Uuid, len(deltas.queue))
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "time"
+
+type DeviceService struct {
+	db Store
+}
+
+func (svc *DeviceService) Checkin(info *DeviceInfo) error {
+	info.LastCheckinAt = time.Now()
+	return svc.db.UpsertDeviceInfo(info)
+}
+
+func (svc *DeviceService) GetAllDevicesInfo() ([]DeviceInfo, error) {
+	return svc.db.GetAllDevicesInfo()
+}
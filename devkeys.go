@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// Developers sign firmware in CI with their own keys, the server keeps only public keys
+// of token subjects and refuses binaries not signed by the subject the firmware is created by.
+// As with the server signature, the raw SHA-256 digest of the binary is signed:
+// Ed25519 over its 32 bytes, or ECDSA P-256 (ASN.1 DER) over the digest,
+// as made by `openssl dgst -sha256 -sign key.pem firmware.bin`.
+
+const (
+	DevKeyAlgEd25519 = "Ed25519"
+	DevKeyAlgES256   = "ES256"
+)
+
+type DeveloperKeysService struct {
+	cfg *Config
+	db  Store
+}
+
+type InvalidDeveloperKeyError struct {
+	reason string
+}
+
+func (e *InvalidDeveloperKeyError) Error() string {
+	return fmt.Sprintf("invalid developer key: %s", e.reason)
+}
+
+type DeveloperKeyAlreadyExistsError struct {
+	kid string
+}
+
+func (e *DeveloperKeyAlreadyExistsError) Error() string {
+	return fmt.Sprintf("developer key %s is already registered", e.kid)
+}
+
+type DeveloperKeyNotFoundError struct {
+	kid string
+}
+
+func (e *DeveloperKeyNotFoundError) Error() string {
+	return fmt.Sprintf("active developer key %s not found", e.kid)
+}
+
+type MissingDeveloperSignatureError struct {
+	subject string
+}
+
+func (e *MissingDeveloperSignatureError) Error() string {
+	return fmt.Sprintf("firmware must be signed by %s", e.subject)
+}
+
+type InvalidDeveloperSignatureError struct {
+	subject string
+}
+
+func (e *InvalidDeveloperSignatureError) Error() string {
+	return fmt.Sprintf("signature doesn't match the binary or any active key of %s", e.subject)
+}
+
+// Returns public key and its algorithm name.
+func parseDeveloperKey(publicKeyPem []byte) (any, string, error) {
+	block, _ := pem.Decode(publicKeyPem)
+	if block == nil {
+		return nil, "", &InvalidDeveloperKeyError{"no PEM data"}
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", &InvalidDeveloperKeyError{err.Error()}
+	}
+
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return k, DevKeyAlgEd25519, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, "", &InvalidDeveloperKeyError{"only P-256 curve is supported"}
+		}
+		return k, DevKeyAlgES256, nil
+	default:
+		return nil, "", &InvalidDeveloperKeyError{"Ed25519 or ECDSA P-256 public key expected"}
+	}
+}
+
+func verifyDeveloperSignature(key any, digest []byte, signature []byte) bool {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, digest, signature)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest, signature)
+	default:
+		return false
+	}
+}
+
+// Registers PKIX PEM public key of the subject.
+func (svc *DeveloperKeysService) Add(subject string, publicKeyPem []byte) (*DeveloperKeyRecord, error) {
+	key, alg, err := parseDeveloperKey(publicKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := publicKeyId(key)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := svc.db.DeveloperKeyExists(kid)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, &DeveloperKeyAlreadyExistsError{kid}
+	}
+
+	return svc.db.AddDeveloperKeyRecord(&DeveloperKeyRecord{
+		Kid:       kid,
+		Subject:   subject,
+		Alg:       alg,
+		PublicKey: string(publicKeyPem),
+		CreatedAt: time.Now(),
+	})
+}
+
+func (svc *DeveloperKeysService) GetAllKeys() ([]DeveloperKeyRecord, error) {
+	return svc.db.GetAllDeveloperKeyRecords()
+}
+
+func (svc *DeveloperKeysService) Revoke(kid string) error {
+	revoked, err := svc.db.RevokeDeveloperKey(kid, time.Now())
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return &DeveloperKeyNotFoundError{kid}
+	}
+	return nil
+}
+
+// Checks signature of the binary with hex encoded SHA-256 against active keys of the subject
+// and returns kid of the matching one. Empty signature is allowed only if
+// firmware.requireDeveloperSignature is off, then kid is empty too.
+func (svc *DeveloperKeysService) Verify(subject string, sha256Hex string, signature []byte) (string, error) {
+	if len(signature) == 0 {
+		if svc.cfg.requireDevSignature {
+			return "", &MissingDeveloperSignatureError{subject}
+		}
+		return "", nil
+	}
+
+	digest, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return "", err
+	}
+
+	krs, err := svc.db.GetActiveDeveloperKeyRecords(subject)
+	if err != nil {
+		return "", err
+	}
+
+	for _, kr := range krs {
+		key, _, err := parseDeveloperKey([]byte(kr.PublicKey))
+		if err != nil {
+			return "", err
+		}
+		if verifyDeveloperSignature(key, digest, signature) {
+			return kr.Kid, nil
+		}
+	}
+
+	return "", &InvalidDeveloperSignatureError{subject}
+}
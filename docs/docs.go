@@ -22,7 +22,7 @@ const docTemplate = `{
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Get binary firmware file with given uuid. Available for all authenticated users",
+                "description": "Get binary firmware file with given uuid. Requires either X-Token with read:{repo} or board:{repo} scope,\nor expires and signature params of the signed bin_url from firmware response.\nSupports Range and If-Range headers to resume interrupted downloads.\nCompressed variant is served as is if requested by encoding param,\ngzip variant is also served with Content-Encoding if accepted by Accept-Encoding header",
                 "summary": "Get binary file",
                 "parameters": [
                     {
@@ -31,6 +31,48 @@ const docTemplate = `{
                         "name": "uuid",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "signed URL expiration time (unix)",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "signed URL signature",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "identity",
+                            "gzip",
+                            "heatshrink",
+                            "lzma"
+                        ],
+                        "type": "string",
+                        "description": "compressed variant to download",
+                        "name": "encoding",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "only gzip is negotiated, e.g. gzip;q=0.5",
+                        "name": "Accept-Encoding",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "byte range, e.g. bytes=1024-",
+                        "name": "Range",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the file, Range is ignored if it doesn't match",
+                        "name": "If-Range",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -38,6 +80,49 @@ const docTemplate = `{
                         "description": "OK",
                         "schema": {
                             "type": "file"
+                        },
+                        "headers": {
+                            "Accept-Ranges": {
+                                "type": "string",
+                                "description": "bytes"
+                            },
+                            "Content-Encoding": {
+                                "type": "string",
+                                "description": "encoding of the variant chosen by Accept-Encoding"
+                            },
+                            "ETag": {
+                                "type": "string",
+                                "description": "strong ETag of the file"
+                            }
+                        }
+                    },
+                    "206": {
+                        "description": "Partial Content",
+                        "schema": {
+                            "type": "file"
+                        },
+                        "headers": {
+                            "Accept-Ranges": {
+                                "type": "string",
+                                "description": "bytes"
+                            },
+                            "Content-Encoding": {
+                                "type": "string",
+                                "description": "encoding of the variant chosen by Accept-Encoding"
+                            },
+                            "ETag": {
+                                "type": "string",
+                                "description": "strong ETag of the file"
+                            }
+                        }
+                    },
+                    "307": {
+                        "description": "redirect to presigned storage URL (s3.presignDownloads)"
+                    },
+                    "400": {
+                        "description": "unsupported encoding",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
                         }
                     },
                     "401": {
@@ -46,8 +131,23 @@ const docTemplate = `{
                             "$ref": "#/definitions/main.HttpError"
                         }
                     },
+                    "403": {
+                        "description": "Access is denied/invalid or expired URL signature",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
                     "404": {
-                        "description": "firmware not found",
+                        "description": "firmware/variant not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "416": {
+                        "description": "Range not satisfiable"
+                    },
+                    "500": {
+                        "description": "stored file is missing",
                         "schema": {
                             "$ref": "#/definitions/main.HttpError"
                         }
@@ -60,9 +160,10 @@ const docTemplate = `{
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Upload firmware binary file. Only for non-board users",
+                "description": "Upload firmware binary file either as \"file\" field of multipart form or as raw request body\nwith application/octet-stream content type. Requires upload:{repo} scope\nUpload is rejected if the file doesn't match digests given in X-Checksum-* headers\nor if it isn't signed by a registered key of the developer the firmware is created by",
                 "consumes": [
-                    "multipart/form-data"
+                    "multipart/form-data",
+                    "application/octet-stream"
                 ],
                 "produces": [
                     "application/json"
@@ -82,6 +183,24 @@ const docTemplate = `{
                         "name": "file",
                         "in": "formData",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "expected MD5 of the file (hex)",
+                        "name": "X-Checksum-Md5",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "expected SHA-256 of the file (hex)",
+                        "name": "X-Checksum-Sha256",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "developer's signature of the file SHA-256 (base64)",
+                        "name": "X-Firmware-Signature",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -89,7 +208,7 @@ const docTemplate = `{
                         "description": "No Content"
                     },
                     "400": {
-                        "description": "File is already uploaded/empty file provided",
+                        "description": "File is already uploaded/empty file provided/digest differs/invalid signature",
                         "schema": {
                             "$ref": "#/definitions/main.HttpError"
                         }
@@ -115,28 +234,83 @@ const docTemplate = `{
                 }
             }
         },
-        "/firmwares": {
+        "/bin/{uuid}/deltas/{base}": {
             "get": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Get all firmwares. Only for non-board users",
-                "produces": [
-                    "application/json"
+                "description": "Get patch from the base firmware binary to the firmware binary (the URL is given by /firmwares/latest).\nRequires either X-Token with read:{repo} or board:{repo} scope, or signed URL params.\nSupports Range and If-Range headers to resume interrupted downloads",
+                "summary": "Get patch",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "base firmware's UUID",
+                        "name": "base",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "signed URL expiration time (unix)",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "signed URL signature",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "byte range, e.g. bytes=1024-",
+                        "name": "Range",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the file, Range is ignored if it doesn't match",
+                        "name": "If-Range",
+                        "in": "header"
+                    }
                 ],
-                "summary": "Get all firmwares",
                 "responses": {
                     "200": {
-                        "description": "ok",
+                        "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/main.ApiFirmwareResponse"
+                            "type": "file"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "strong ETag of the file"
+                            }
+                        }
+                    },
+                    "206": {
+                        "description": "Partial Content",
+                        "schema": {
+                            "type": "file"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "strong ETag of the file"
                             }
                         }
                     },
+                    "307": {
+                        "description": "redirect to presigned storage URL (s3.presignDownloads)"
+                    },
                     "401": {
                         "description": "Invalid auth token",
                         "schema": {
@@ -144,35 +318,59 @@ const docTemplate = `{
                         }
                     },
                     "403": {
-                        "description": "Access is denied",
+                        "description": "Access is denied/invalid or expired URL signature",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "firmware/patch not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "416": {
+                        "description": "Range not satisfiable"
+                    },
+                    "500": {
+                        "description": "stored file is missing",
                         "schema": {
                             "$ref": "#/definitions/main.HttpError"
                         }
                     }
                 }
-            },
+            }
+        },
+        "/bin/{uuid}/uploads": {
             "post": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Create firmare record in db. Upload file to POST /bin/{uuid} after. Only for non-board users",
+                "description": "Start resumable upload of firmware binary file with declared size (and MD5, SHA-256, optional).\nUpload chunks with PUT /bin/{uuid}/uploads/{id}, then POST /bin/{uuid}/uploads/{id}/finalize.\nUpload not finalized within upload.sessionLifetime is removed. Requires upload:{repo} scope",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Create firmware record in db",
+                "summary": "Start resumable upload",
                 "parameters": [
                     {
-                        "description": "firmware info",
-                        "name": "firmware",
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "file info",
+                        "name": "upload",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/main.ApiAddFirmwareInfoRequest"
+                            "$ref": "#/definitions/main.ApiCreateUploadRequest"
                         }
                     }
                 ],
@@ -180,7 +378,13 @@ const docTemplate = `{
                     "201": {
                         "description": "ok",
                         "schema": {
-                            "$ref": "#/definitions/main.ApiFirmwareResponse"
+                            "$ref": "#/definitions/main.ApiUploadResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "File is already uploaded/invalid file info",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
                         }
                     },
                     "401": {
@@ -190,7 +394,13 @@ const docTemplate = `{
                         }
                     },
                     "403": {
-                        "description": "Access is denied",
+                        "description": "Access denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "Firmware not found",
                         "schema": {
                             "$ref": "#/definitions/main.HttpError"
                         }
@@ -198,31 +408,39 @@ const docTemplate = `{
                 }
             }
         },
-        "/firmwares/latest": {
+        "/bin/{uuid}/uploads/{id}": {
             "get": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Get latest firmware version for given repo and tags. Only for boards",
+                "description": "Get number of bytes uploaded (offset to continue from). Requires upload:{repo} scope",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get latest firmware version",
+                "summary": "Get resumable upload progress",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "name of firmware's repo",
-                        "name": "repo",
-                        "in": "query"
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "ok",
                         "schema": {
-                            "$ref": "#/definitions/main.ApiFirmwareResponse"
+                            "$ref": "#/definitions/main.ApiUploadResponse"
                         }
                     },
                     "401": {
@@ -232,37 +450,67 @@ const docTemplate = `{
                         }
                     },
                     "403": {
-                        "description": "Access is denied",
+                        "description": "Access denied",
                         "schema": {
                             "$ref": "#/definitions/main.HttpError"
                         }
                     },
                     "404": {
-                        "description": "no firmware found for this board in repo",
+                        "description": "Firmware/upload not found",
                         "schema": {
                             "$ref": "#/definitions/main.HttpError"
                         }
                     }
                 }
-            }
-        },
-        "/users/me": {
-            "get": {
+            },
+            "put": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Get authenticated user",
+                "description": "Append chunk (raw request body) to resumable upload. Offset must be equal to the number\nof bytes uploaded so far. If the request is interrupted, the received part of the chunk is kept,\nget the new offset with GET /bin/{uuid}/uploads/{id}. Requires upload:{repo} scope",
+                "consumes": [
+                    "application/octet-stream"
+                ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get authenticated user",
+                "summary": "Upload chunk",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "offset of the chunk in file",
+                        "name": "offset",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "ok",
                         "schema": {
-                            "$ref": "#/definitions/main.ApiUserResponse"
+                            "$ref": "#/definitions/main.ApiUploadResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid offset",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
                         }
                     },
                     "401": {
@@ -270,58 +518,1046 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/main.HttpError"
                         }
+                    },
+                    "403": {
+                        "description": "Access denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "Firmware/upload not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "409": {
+                        "description": "Offset doesn't match uploaded size",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
                     }
                 }
-            }
-        }
-    },
-    "definitions": {
-        "main.ApiAddFirmwareInfoRequest": {
-            "type": "object",
-            "required": [
-                "boards",
-                "repo_name"
-            ],
-            "properties": {
-                "boards": {
-                    "type": "array",
-                    "minItems": 1,
-                    "items": {
-                        "type": "string"
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
                     }
-                },
-                "commit_id": {
-                    "type": "string"
-                },
-                "description": {
-                    "type": "string"
-                },
-                "repo_name": {
-                    "type": "string"
-                }
-            }
-        },
-        "main.ApiFirmwareInfoResponse": {
-            "type": "object",
-            "properties": {
-                "boards": {
-                    "type": "array",
-                    "items": {
-                        "type": "string"
+                ],
+                "description": "Remove upload session and uploaded data. Requires upload:{repo} scope",
+                "summary": "Abort resumable upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
-                },
-                "commit_id": {
-                    "type": "string"
-                },
-                "created_at": {
-                    "type": "integer"
-                },
-                "created_by": {
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "Firmware/upload not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/bin/{uuid}/uploads/{id}/finalize": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Verify size (and digests if declared) of the uploaded file and add it to the firmware.\nUpload is removed if a digest or the developer's signature doesn't match. Requires upload:{repo} scope",
+                "summary": "Finalize resumable upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "developer's signature of the file SHA-256 (base64)",
+                        "name": "X-Firmware-Signature",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "File is already uploaded/size or digest differs/invalid signature",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "Firmware/upload not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/boards/{board}/subscriptions": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get channels the board is subscribed to in repos the user has read:{repo} scope for.\nBoard gets stable releases of repos not listed here",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get board subscriptions",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "board name",
+                        "name": "board",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.ApiSubscriptionResponse"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Set release channel the board gets firmwares of the repo from. Requires upload:{repo} scope",
+                "consumes": [
+                    "application/json"
+                ],
+                "summary": "Subscribe board to channel",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "board name",
+                        "name": "board",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "subscription",
+                        "name": "subscription",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiSubscriptionRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Invalid subscription",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/devices": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get last reported state of all boards from repos the user has read:{repo} scope for,\na board checking in for several repos is listed for each of them",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get all devices",
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.ApiDeviceResponse"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/devices/checkin": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Report firmware the board is running, its uptime (seconds) and last reset reason.\nBoard is identified by token subject. Requires board:{repo} scope",
+                "consumes": [
+                    "application/json"
+                ],
+                "summary": "Report board state",
+                "parameters": [
+                    {
+                        "description": "board state",
+                        "name": "state",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiDeviceCheckinRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Invalid board state",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/firmwares": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get a page of firmwares from repos the user has read:{repo} scope for, sorted by repo and version (descending) by default.\nCursor of the next page is returned in X-Next-Cursor header, absent on the last page.\nPass it as cursor with the same filters and sort to get the next page",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get firmwares",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "name of firmware's repo",
+                        "name": "repo",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "firmwares for the board only",
+                        "name": "board",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "token subject the firmware was created by",
+                        "name": "created_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "prefix of commit id",
+                        "name": "commit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "unix time, inclusive",
+                        "name": "created_after",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "unix time, exclusive",
+                        "name": "created_before",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "whether binary file is uploaded",
+                        "name": "has_binary",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "-version",
+                            "version",
+                            "-created_at",
+                            "created_at"
+                        ],
+                        "type": "string",
+                        "default": "-version",
+                        "description": "sort order, version is sorted within repo",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "maximum": 1000,
+                        "minimum": 1,
+                        "type": "integer",
+                        "default": 100,
+                        "description": "page size",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "X-Next-Cursor of the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.ApiFirmwareResponse"
+                            }
+                        },
+                        "headers": {
+                            "X-Next-Cursor": {
+                                "type": "string",
+                                "description": "cursor of the next page"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid query params",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Create firmare record in db. Upload file to POST /bin/{uuid} after.\nVersion must be a semantic version unique in the repo. Requires upload:{repo} scope",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Create firmware record in db",
+                "parameters": [
+                    {
+                        "description": "firmware info",
+                        "name": "firmware",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiAddFirmwareInfoRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "ok",
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiFirmwareResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid firmware info",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "409": {
+                        "description": "Version already exists in repo",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/firmwares/latest": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get firmware with the highest semantic version for given repo and tags. Requires board:{repo} scope.\nReleases from the channel board is subscribed to (stable by default) and more stable ones are considered.\nBoard may pass firmware it runs (current_uuid, current_version or If-None-Match with ETag\nfrom the previous response), then 304 without body is returned if it is still the latest one,\notherwise the response contains a patch from it, if there is one",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get latest firmware version",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "name of firmware's repo",
+                        "name": "repo",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "stable",
+                            "beta",
+                            "dev"
+                        ],
+                        "type": "string",
+                        "description": "override board's channel",
+                        "name": "channel",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "UUID of firmware the board runs",
+                        "name": "current_uuid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "version of firmware the board runs",
+                        "name": "current_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of firmware the board runs",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiFirmwareResponse"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "firmware ETag for If-None-Match"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "board runs the latest firmware"
+                    },
+                    "400": {
+                        "description": "Unknown channel/invalid version",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "no firmware found for this board in repo",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/firmwares/signing-key": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get public key that firmware binaries are signed with.\nThe signature in firmware info is made over the raw 32 byte SHA-256 digest of the binary",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get firmware signing key",
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiFirmwareSigningKeyResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/firmwares/{uuid}/events": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Report update lifecycle event of the board for firmware with given uuid,\nerror_code is only stored for failed updates. Requires board:{repo} scope",
+                "consumes": [
+                    "application/json"
+                ],
+                "summary": "Report update progress",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "update event",
+                        "name": "event",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiUpdateEventRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Invalid event",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "Firmware not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/firmwares/{uuid}/rollout": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get percentage of boards the firmware is delivered to. Requires read:{repo} scope",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get rollout",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiRolloutResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "Firmware not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Set percentage of boards the firmware is delivered to, other boards get the previous firmware.\nBoards are chosen by stable hash of their names, so raising the percentage only adds boards.\nRollout can be paused (no boards get the firmware) or resumed, it is also paused automatically\nwhen too many boards report failed updates. Requires upload:{repo} scope",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Update rollout",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "rollout",
+                        "name": "rollout",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiRolloutRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiRolloutResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid percentage",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "Firmware not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/firmwares/{uuid}/stats": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get number of boards by the last update status they reported for firmware with given uuid.\nRequires read:{repo} scope",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get update stats",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "firmware's UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiUpdateStatsResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "403": {
+                        "description": "Access is denied",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    },
+                    "404": {
+                        "description": "Firmware not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/me": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get authenticated user",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get authenticated user",
+                "responses": {
+                    "200": {
+                        "description": "ok",
+                        "schema": {
+                            "$ref": "#/definitions/main.ApiUserResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid auth token",
+                        "schema": {
+                            "$ref": "#/definitions/main.HttpError"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "main.ApiAddFirmwareInfoRequest": {
+            "type": "object",
+            "required": [
+                "boards",
+                "repo_name",
+                "version"
+            ],
+            "properties": {
+                "boards": {
+                    "type": "array",
+                    "minItems": 1,
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "channel": {
+                    "default": "stable",
+                    "enum": [
+                        "stable",
+                        "beta",
+                        "dev"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Channel"
+                        }
+                    ]
+                },
+                "commit_id": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "repo_name": {
+                    "type": "string"
+                },
+                "rollout_percentage": {
+                    "description": "Percentage of boards to deliver the firmware to, raise it later with PUT /firmwares/{uuid}/rollout",
+                    "type": "integer",
+                    "default": 100,
+                    "maximum": 100,
+                    "minimum": 0
+                },
+                "version": {
+                    "type": "string",
+                    "example": "1.2.0-rc.1"
+                }
+            }
+        },
+        "main.ApiCreateUploadRequest": {
+            "type": "object",
+            "required": [
+                "size"
+            ],
+            "properties": {
+                "md5": {
+                    "type": "string"
+                },
+                "sha256": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer",
+                    "minimum": 1
+                }
+            }
+        },
+        "main.ApiDeltaResponse": {
+            "type": "object",
+            "properties": {
+                "base_sha256": {
+                    "description": "board must check its image against it before patching",
+                    "type": "string"
+                },
+                "base_uuid": {
+                    "type": "string"
+                },
+                "sha256": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "url": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ApiDeviceCheckinRequest": {
+            "type": "object",
+            "required": [
+                "repo_name"
+            ],
+            "properties": {
+                "commit_id": {
+                    "type": "string"
+                },
+                "firmware_uuid": {
+                    "type": "string"
+                },
+                "repo_name": {
+                    "type": "string"
+                },
+                "reset_reason": {
+                    "type": "string"
+                },
+                "uptime": {
+                    "type": "integer",
+                    "minimum": 0
+                }
+            }
+        },
+        "main.ApiDeviceResponse": {
+            "type": "object",
+            "properties": {
+                "commit_id": {
+                    "type": "string"
+                },
+                "firmware_uuid": {
+                    "type": "string"
+                },
+                "last_checkin_at": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "repo_name": {
+                    "type": "string"
+                },
+                "reset_reason": {
+                    "type": "string"
+                },
+                "uptime": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.ApiFirmwareInfoResponse": {
+            "type": "object",
+            "properties": {
+                "boards": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "channel": {
+                    "$ref": "#/definitions/main.Channel"
+                },
+                "commit_id": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "integer"
+                },
+                "created_by": {
                     "type": "string"
                 },
                 "description": {
                     "type": "string"
                 },
+                "developer_kid": {
+                    "type": "string"
+                },
+                "developer_signature": {
+                    "description": "Signature made by the developer (created_by) in CI (hex), empty if not required",
+                    "type": "string"
+                },
                 "id": {
                     "type": "integer"
                 },
@@ -331,11 +1567,24 @@ const docTemplate = `{
                 "repo_name": {
                     "type": "string"
                 },
+                "sha256": {
+                    "type": "string"
+                },
+                "signature": {
+                    "description": "Ed25519 signature of the raw SHA-256 digest (hex), see GET /firmwares/signing-key",
+                    "type": "string"
+                },
+                "signature_kid": {
+                    "type": "string"
+                },
                 "size": {
                     "type": "integer"
                 },
                 "uuid": {
                     "type": "string"
+                },
+                "version": {
+                    "type": "string"
                 }
             }
         },
@@ -345,8 +1594,197 @@ const docTemplate = `{
                 "bin_url": {
                     "type": "string"
                 },
+                "delta": {
+                    "description": "only for the latest firmware, if board's one is known",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.ApiDeltaResponse"
+                        }
+                    ]
+                },
                 "info": {
                     "$ref": "#/definitions/main.ApiFirmwareInfoResponse"
+                },
+                "variants": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.ApiVariantResponse"
+                    }
+                }
+            }
+        },
+        "main.ApiFirmwareSigningKeyResponse": {
+            "type": "object",
+            "properties": {
+                "alg": {
+                    "type": "string",
+                    "example": "Ed25519"
+                },
+                "kid": {
+                    "type": "string"
+                },
+                "public_key": {
+                    "description": "PKIX PEM",
+                    "type": "string"
+                }
+            }
+        },
+        "main.ApiRolloutRequest": {
+            "type": "object",
+            "properties": {
+                "paused": {
+                    "type": "boolean"
+                },
+                "percentage": {
+                    "type": "integer",
+                    "maximum": 100,
+                    "minimum": 0
+                }
+            }
+        },
+        "main.ApiRolloutResponse": {
+            "type": "object",
+            "properties": {
+                "firmware_uuid": {
+                    "type": "string"
+                },
+                "pause_reason": {
+                    "type": "string"
+                },
+                "paused": {
+                    "type": "boolean"
+                },
+                "paused_at": {
+                    "description": "0 if not paused",
+                    "type": "integer"
+                },
+                "percentage": {
+                    "type": "integer"
+                },
+                "updated_at": {
+                    "type": "integer"
+                },
+                "updated_by": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ApiSubscriptionRequest": {
+            "type": "object",
+            "required": [
+                "channel",
+                "repo_name"
+            ],
+            "properties": {
+                "channel": {
+                    "enum": [
+                        "stable",
+                        "beta",
+                        "dev"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Channel"
+                        }
+                    ]
+                },
+                "repo_name": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ApiSubscriptionResponse": {
+            "type": "object",
+            "properties": {
+                "channel": {
+                    "$ref": "#/definitions/main.Channel"
+                },
+                "repo_name": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ApiUpdateEventRequest": {
+            "type": "object",
+            "required": [
+                "status"
+            ],
+            "properties": {
+                "error_code": {
+                    "type": "string"
+                },
+                "status": {
+                    "enum": [
+                        "downloading",
+                        "installed",
+                        "booted",
+                        "rolled_back",
+                        "failed"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.UpdateStatus"
+                        }
+                    ]
+                }
+            }
+        },
+        "main.ApiUpdateStatsResponse": {
+            "type": "object",
+            "properties": {
+                "booted": {
+                    "type": "integer"
+                },
+                "devices": {
+                    "type": "integer"
+                },
+                "downloading": {
+                    "type": "integer"
+                },
+                "error_codes": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                },
+                "failed": {
+                    "type": "integer"
+                },
+                "firmware_uuid": {
+                    "type": "string"
+                },
+                "installed": {
+                    "type": "integer"
+                },
+                "rolled_back": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.ApiUploadResponse": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "integer"
+                },
+                "firmware_uuid": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "md5": {
+                    "type": "string"
+                },
+                "offset": {
+                    "description": "number of bytes uploaded",
+                    "type": "integer"
+                },
+                "sha256": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
                 }
             }
         },
@@ -358,9 +1796,74 @@ const docTemplate = `{
                 },
                 "name": {
                     "type": "string"
+                },
+                "scopes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "main.ApiVariantResponse": {
+            "type": "object",
+            "properties": {
+                "encoding": {
+                    "enum": [
+                        "gzip",
+                        "heatshrink",
+                        "lzma"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Encoding"
+                        }
+                    ]
+                },
+                "sha256": {
+                    "description": "of the compressed data",
+                    "type": "string"
+                },
+                "size": {
+                    "description": "compressed size",
+                    "type": "integer"
+                },
+                "url": {
+                    "description": "bin_url with encoding param, served as is",
+                    "type": "string"
                 }
             }
         },
+        "main.Channel": {
+            "type": "string",
+            "enum": [
+                "stable",
+                "beta",
+                "dev"
+            ],
+            "x-enum-varnames": [
+                "ChannelStable",
+                "ChannelBeta",
+                "ChannelDev"
+            ]
+        },
+        "main.Encoding": {
+            "type": "string",
+            "enum": [
+                "gzip",
+                "heatshrink",
+                "lzma"
+            ],
+            "x-enum-comments": {
+                "EncodingHeatshrink": "raw stream, window and lookahead sizes are in the config",
+                "EncodingLzma": ".lzma (LZMA-Alone) with the uncompressed size in the header"
+            },
+            "x-enum-varnames": [
+                "EncodingGzip",
+                "EncodingHeatshrink",
+                "EncodingLzma"
+            ]
+        },
         "main.HttpError": {
             "type": "object",
             "properties": {
@@ -371,6 +1874,23 @@ const docTemplate = `{
                     "type": "string"
                 }
             }
+        },
+        "main.UpdateStatus": {
+            "type": "string",
+            "enum": [
+                "downloading",
+                "installed",
+                "booted",
+                "rolled_back",
+                "failed"
+            ],
+            "x-enum-varnames": [
+                "UpdateDownloading",
+                "UpdateInstalled",
+                "UpdateBooted",
+                "UpdateRolledBack",
+                "UpdateFailed"
+            ]
         }
     },
     "securityDefinitions": {
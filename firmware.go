@@ -1,14 +1,46 @@
 package main
 
 import (
-	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
+
 	guuid "github.com/google/uuid"
 )
 
+type Channel string
+
+// Ordered from the most to the least stable, boards subscribed to a channel
+// also get releases from the more stable ones.
+const (
+	ChannelStable Channel = "stable"
+	ChannelBeta   Channel = "beta"
+	ChannelDev    Channel = "dev"
+)
+
+var CHANNELS = []Channel{ChannelStable, ChannelBeta, ChannelDev}
+
+// Returns channels whose releases are delivered to boards subscribed to ch.
+func channelsUpTo(ch Channel) []Channel {
+	for i, c := range CHANNELS {
+		if c == ch {
+			return CHANNELS[:i+1]
+		}
+	}
+	return CHANNELS[:1]
+}
+
 type FirmwareService struct {
-	db   *DB
-	bins *BinariesService
+	cfg        *Config
+	db         Store
+	bins       *BinariesService
+	signer     *FirmwareSigner
+	devKeys    *DeveloperKeysService
+	deltas     *DeltaService
+	compressor *CompressionService
 }
 
 type Md5DiffersError struct {
@@ -20,12 +52,57 @@ func (e *Md5DiffersError) Error() string {
 	return fmt.Sprintf("MD5 %s (given) != %s (computed)", e.given, e.computed)
 }
 
+type Sha256DiffersError struct {
+	given    string
+	computed string
+}
+
+func (e *Sha256DiffersError) Error() string {
+	return fmt.Sprintf("SHA-256 %s (given) != %s (computed)", e.given, e.computed)
+}
+
+// Digests of a firmware file expected by the uploader, hex encoded, empty ones are not checked.
+type ExpectedDigests struct {
+	Md5    string
+	Sha256 string
+}
+
+func (d ExpectedDigests) check(sb *StagedBinary) error {
+	if d.Md5 != "" && !strings.EqualFold(d.Md5, sb.Md5) {
+		return &Md5DiffersError{d.Md5, sb.Md5}
+	}
+	if d.Sha256 != "" && !strings.EqualFold(d.Sha256, sb.Sha256) {
+		return &Sha256DiffersError{d.Sha256, sb.Sha256}
+	}
+	return nil
+}
+
+type VersionAlreadyExistsError struct {
+	version string
+}
+
+func (e *VersionAlreadyExistsError) Error() string {
+	return fmt.Sprintf("firmware with version %s already exists in repo", e.version)
+}
+
 type FirmwareNotFoundError struct{}
 
 func (e *FirmwareNotFoundError) Error() string {
 	return "firmware not found"
 }
 
+type EmptyFirmwareFileError struct{}
+
+func (e *EmptyFirmwareFileError) Error() string {
+	return "empty file is not allowed"
+}
+
+type InvalidCursorError struct{}
+
+func (e *InvalidCursorError) Error() string {
+	return "invalid cursor"
+}
+
 type FirmwareFileAlreadyUploaded struct{}
 
 func (e *FirmwareFileAlreadyUploaded) Error() string {
@@ -33,12 +110,31 @@ func (e *FirmwareFileAlreadyUploaded) Error() string {
 }
 
 func (svc *FirmwareService) CreateFirmware(info *FirmwareInfo) (*FirmwareInfo, error) {
+	version, err := ParseVersion(info.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions differing only in build metadata have the same precedence, so they are duplicates too.
+	info.VersionKey = version.key()
+	exists, err := svc.db.FirmwareVersionExists(info.RepoName, info.VersionKey)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, &VersionAlreadyExistsError{info.Version}
+	}
+
 	info.Size = 0
 	info.Uuid = guuid.New().String()
+	if info.Channel == "" {
+		info.Channel = ChannelStable
+	}
 	return svc.db.AddFirmwareInfo(info)
 }
 
-func (svc *FirmwareService) AddFirmwareFile(uuid string, bytes []byte) error {
+// Binary is added only if devSignature is made by a key of the firmware's CreatedBy subject.
+func (svc *FirmwareService) AddFirmwareFile(uuid string, r io.Reader, expected ExpectedDigests, devSignature []byte) error {
 	info, err := svc.db.GetFirmareInfoByUuid(uuid)
 	if err != nil {
 		return err
@@ -51,31 +147,201 @@ func (svc *FirmwareService) AddFirmwareFile(uuid string, bytes []byte) error {
 		return &FirmwareFileAlreadyUploaded{}
 	}
 
-	h := md5.New()
-	h.Write([]byte(bytes))
-	info.Md5 = fmt.Sprintf("%x", h.Sum(nil))
-	info.Size = len(bytes)
+	sb, err := svc.bins.Stage(r)
+	if err != nil {
+		return err
+	}
+
+	return svc.addStagedFile(info, sb, expected, devSignature)
+}
+
+func (svc *FirmwareService) addStagedFile(info *FirmwareInfo, sb *StagedBinary, expected ExpectedDigests, devSignature []byte) error {
+	defer svc.bins.Discard(sb)
 
-	if err := svc.bins.AddFirmwareBinary(uuid, bytes); err != nil {
+	if sb.Size == 0 {
+		return &EmptyFirmwareFileError{}
+	}
+	if err := expected.check(sb); err != nil {
+		return err
+	}
+
+	devKid, err := svc.devKeys.Verify(info.CreatedBy, sb.Sha256, devSignature)
+	if err != nil {
+		return err
+	}
+
+	// Compressing large images takes a while, other uploads to the firmware aren't blocked by it.
+	svs, err := svc.compressor.StageVariants(sb)
+	if err != nil {
 		return err
 	}
+	defer svc.compressor.DiscardVariants(svs)
+
+	defer svc.bins.lockFirmware(info.Uuid)()
+
+	// Another upload to the firmware may have finished while this one was staged.
+	current, err := svc.db.GetFirmareInfoByUuid(info.Uuid)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return &FirmwareNotFoundError{}
+	}
+	if current.hasBin() {
+		return &FirmwareFileAlreadyUploaded{}
+	}
+
+	signature, err := svc.signer.Sign(sb.Sha256)
+	if err != nil {
+		return err
+	}
+
+	info.Md5 = sb.Md5
+	info.Sha256 = sb.Sha256
+	info.Size = int(sb.Size)
+	info.Signature = signature
+	info.SignatureKid = svc.signer.Kid()
+	info.DevSignature = hex.EncodeToString(devSignature)
+	info.DevKid = devKid
+
+	if err := svc.bins.Commit(sb); err != nil {
+		return err
+	}
+	if err := svc.addCommittedFile(info, svs); err != nil {
+		svc.bins.Release(sb.Sha256)
+		return err
+	}
+
+	svc.deltas.GenerateAsync(*info)
+	return nil
+}
+
+func (svc *FirmwareService) addCommittedFile(info *FirmwareInfo, svs []StagedVariant) error {
+	variants, err := svc.compressor.StoreVariants(info, svs)
+	if err != nil {
+		return err
+	}
+	info.Variants = variants
 
 	return svc.db.UpdateFirmwareFileInfo(info)
 }
 
-func (serv *FirmwareService) GetLatestFirmware(repo string, board string) (*FirmwareInfo, error) {
-	return serv.db.GetLatestFirmwareInfo(repo, board)
+// Channel may be empty, then the channel board is subscribed to is used (stable by default).
+// Boards not yet included in a staged rollout get the previous firmware.
+func (serv *FirmwareService) GetLatestFirmware(repo string, board string, channel Channel) (*FirmwareInfo, error) {
+	if channel == "" {
+		sub, err := serv.db.GetBoardSubscription(board, repo)
+		if err != nil {
+			return nil, err
+		}
+
+		channel = ChannelStable
+		if sub != nil {
+			channel = sub.Channel
+		}
+	}
+
+	rcs, err := serv.db.GetRolloutCandidates(repo, board, channelsUpTo(channel))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rc := range rcs {
+		if inRollout(&rc, board) {
+			return serv.db.GetFirmareInfoByUuid(rc.Uuid)
+		}
+	}
+
+	return nil, nil
 }
 
-func (serv *FirmwareService) GetFirmwareBinaryPath(uuid string) (string, error) {
-	fi, err := serv.db.GetFirmareInfoByUuid(uuid)
-	if err != nil || fi == nil || !fi.hasBin() {
-		return "", err
+func (serv *FirmwareService) SetBoardChannel(board string, repo string, channel Channel) error {
+	return serv.db.SetBoardSubscription(&BoardSubscription{board, repo, channel})
+}
+
+func (serv *FirmwareService) GetBoardSubscriptions(board string) ([]BoardSubscription, error) {
+	return serv.db.GetBoardSubscriptions(board)
+}
+
+func (serv *FirmwareService) GetFirmwareInfo(uuid string) (*FirmwareInfo, error) {
+	return serv.db.GetFirmareInfoByUuid(uuid)
+}
+
+func (serv *FirmwareService) GetBinaryFile(fi *FirmwareInfo) StoredFile {
+	return serv.bins.GetBinaryFile(fi)
+}
+
+// Finds firmware the board runs by uuid or version (if uuid is empty) and returns patch
+// from it to the given firmware, nil if there is none.
+func (serv *FirmwareService) GetDelta(fi *FirmwareInfo, baseUuid string, baseVersion *Version) (*Delta, *FirmwareInfo, error) {
+	var base *FirmwareInfo
+	var err error
+	if baseUuid != "" {
+		base, err = serv.db.GetFirmareInfoByUuid(baseUuid)
+	} else if baseVersion != nil {
+		base, err = serv.db.GetFirmwareInfoByVersion(fi.RepoName, baseVersion.key())
 	}
+	if err != nil || base == nil || base.RepoName != fi.RepoName {
+		return nil, nil, err
+	}
+
+	d, err := serv.deltas.Get(fi, base)
+	if err != nil || d == nil {
+		return nil, nil, err
+	}
+
+	return d, base, nil
+}
+
+func (serv *FirmwareService) GetDeltaFile(fi *FirmwareInfo, base *FirmwareInfo, d *Delta) StoredFile {
+	return serv.bins.GetDeltaFile(fi, base, d)
+}
 
-	return serv.bins.GetFirmwareBinaryPath(uuid), nil
+func (serv *FirmwareService) GetVariantFile(fi *FirmwareInfo, v *Variant) StoredFile {
+	return serv.bins.GetVariantFile(fi, v)
+}
+
+// Returns CorruptedFileError if the file is missing, reading fails with it if the
+// file doesn't match its SHA-256.
+func (serv *FirmwareService) OpenFile(f StoredFile) (io.ReadSeekCloser, error) {
+	return serv.bins.Open(f)
+}
+
+func (serv *FirmwareService) GetPresignedUrl(f StoredFile) (string, error) {
+	return serv.bins.PresignedUrl(f)
+}
+
+func (serv *FirmwareService) GetSigner() *FirmwareSigner {
+	return serv.signer
 }
 
 func (serv *FirmwareService) GetAllFirmwaresInfo() ([]FirmwareInfo, error) {
 	return serv.db.GetAllFirmwaresInfo()
 }
+
+// Returns up to limit firmwares after the cursor (from the first one if it's empty)
+// and the cursor of the next page, empty for the last page.
+func (serv *FirmwareService) ListFirmwares(filter *FirmwareFilter, sort FirmwareSort, cursor string, limit int) ([]FirmwareInfo, string, error) {
+	var after *FirmwareCursor
+	if cursor != "" {
+		after = &FirmwareCursor{}
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || json.Unmarshal(data, after) != nil || after.Sort != sort {
+			return nil, "", &InvalidCursorError{}
+		}
+	}
+
+	// One more firmware tells if there is the next page.
+	fis, err := serv.db.ListFirmwaresInfo(filter, sort, after, limit+1)
+	if err != nil || len(fis) <= limit {
+		return fis, "", err
+	}
+	fis = fis[:limit]
+
+	last := fis[limit-1]
+	data, err := json.Marshal(FirmwareCursor{sort, last.RepoName, last.VersionKey, last.Id})
+	if err != nil {
+		return nil, "", err
+	}
+	return fis, base64.RawURLEncoding.EncodeToString(data), nil
+}
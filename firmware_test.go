@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Adds firmwares to several repos, versions not in order of creation.
+func addTestFirmwares(t *testing.T, db *DB) []FirmwareInfo {
+	t.Helper()
+
+	versions := map[string][]string{
+		"repoA": {"1.2.0", "1.0.0", "2.0.0-rc.1", "1.10.0", "2.0.0", "1.0.1"},
+		"repoB": {"0.1.0", "0.0.9", "0.1.0-beta"},
+		"repoC": {"3.0.0"},
+	}
+	created := time.Now().Add(-time.Hour)
+
+	var fis []FirmwareInfo
+	for i := 0; i < 6; i++ {
+		for _, repo := range []string{"repoC", "repoA", "repoB"} {
+			if i >= len(versions[repo]) {
+				continue
+			}
+			version := versions[repo][i]
+			fi, err := db.AddFirmwareInfo(&FirmwareInfo{
+				Uuid:       repo + "-" + version,
+				RepoName:   repo,
+				Boards:     []string{"board"},
+				CreatedAt:  created.Add(time.Duration(len(fis)) * time.Second),
+				Channel:    ChannelStable,
+				Version:    version,
+				VersionKey: versionKey(t, version),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fis = append(fis, *fi)
+		}
+	}
+	return fis
+}
+
+func sortedUuids(fis []FirmwareInfo, s FirmwareSort) []string {
+	fis = slices.Clone(fis)
+	sort.Slice(fis, func(i, j int) bool {
+		a, b := fis[i], fis[j]
+		switch s {
+		case SortVersionAsc, SortVersionDesc:
+			if a.RepoName != b.RepoName {
+				return a.RepoName < b.RepoName
+			}
+			if a.VersionKey != b.VersionKey {
+				return (a.VersionKey < b.VersionKey) == (s == SortVersionAsc)
+			}
+			return (a.Id < b.Id) == (s == SortVersionAsc)
+		default:
+			return (a.Id < b.Id) == (s == SortCreatedAsc)
+		}
+	})
+
+	uuids := make([]string, len(fis))
+	for i := range fis {
+		uuids[i] = fis[i].Uuid
+	}
+	return uuids
+}
+
+// Follows the cursors until the last page, failing on a page that isn't full
+// before it.
+func listAllPages(t *testing.T, serv *FirmwareService, filter *FirmwareFilter, s FirmwareSort, limit int) []string {
+	t.Helper()
+
+	var uuids []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("cursors don't reach the last page")
+		}
+		fis, next, err := serv.ListFirmwares(filter, s, cursor, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != "" && len(fis) != limit {
+			t.Fatalf("page of %d firmwares with limit %d isn't the last one", len(fis), limit)
+		}
+		for _, fi := range fis {
+			uuids = append(uuids, fi.Uuid)
+		}
+		if next == "" {
+			return uuids
+		}
+		cursor = next
+	}
+}
+
+func TestListFirmwaresPages(t *testing.T) {
+	db := newTestDB(t)
+	serv := &FirmwareService{db: db}
+	fis := addTestFirmwares(t, db)
+
+	var repoB []FirmwareInfo
+	for _, fi := range fis {
+		if fi.RepoName == "repoB" {
+			repoB = append(repoB, fi)
+		}
+	}
+
+	for _, s := range FIRMWARE_SORTS {
+		want := sortedUuids(fis, s)
+		wantB := sortedUuids(repoB, s)
+		// Pages ending on a repo boundary, within a repo, and a single full page.
+		for _, limit := range []int{1, 2, 3, 4, 6, len(fis), len(fis) + 1} {
+			t.Run(fmt.Sprintf("%s/%d", s, limit), func(t *testing.T) {
+				if got := listAllPages(t, serv, &FirmwareFilter{}, s, limit); !slices.Equal(got, want) {
+					t.Errorf("pages = %v\nwant %v", got, want)
+				}
+				filter := &FirmwareFilter{Repos: []string{"repoB"}}
+				if got := listAllPages(t, serv, filter, s, limit); !slices.Equal(got, wantB) {
+					t.Errorf("pages of repoB = %v\nwant %v", got, wantB)
+				}
+			})
+		}
+	}
+}
+
+func TestListFirmwaresInvalidCursor(t *testing.T) {
+	db := newTestDB(t)
+	serv := &FirmwareService{db: db}
+	addTestFirmwares(t, db)
+
+	_, next, err := serv.ListFirmwares(&FirmwareFilter{}, SortVersionAsc, "", 2)
+	if err != nil || next == "" {
+		t.Fatalf("ListFirmwares() = %q, %v", next, err)
+	}
+
+	cursors := map[string]struct {
+		cursor string
+		sort   FirmwareSort
+	}{
+		"other sort": {next, SortCreatedDesc},
+		"not base64": {"not a cursor!", SortVersionAsc},
+		"not json":   {base64.RawURLEncoding.EncodeToString([]byte("cursor")), SortVersionAsc},
+		"no sort":    {base64.RawURLEncoding.EncodeToString([]byte(`{"i":1}`)), SortVersionAsc},
+	}
+	for name, c := range cursors {
+		_, _, err := serv.ListFirmwares(&FirmwareFilter{}, c.sort, c.cursor, 2)
+		if _, ok := err.(*InvalidCursorError); !ok {
+			t.Errorf("%s: ListFirmwares() error = %v, want InvalidCursorError", name, err)
+		}
+	}
+}
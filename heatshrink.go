@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// Encoder of heatshrink (github.com/atomicobject/heatshrink) format, an LZSS variant
+// that decompresses with a few hundred bytes of RAM. The stream has no header,
+// the decoder must be built with the same window and lookahead sizes:
+//
+//	1, byte                              literal
+//	0, distance-1 (window bits), length-1 (lookahead bits)  backreference
+//
+// Bits are written MSB first, the last byte is padded with zeros.
+
+// Only so many previous positions with the same two bytes are tried.
+const HEATSHRINK_MAX_CHAIN = 256
+
+type bitWriter struct {
+	w     *bufio.Writer
+	cur   byte
+	nbits int
+}
+
+func (w *bitWriter) write(value int, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | byte(value>>i&1)
+		w.nbits++
+		if w.nbits == 8 {
+			// Write errors are kept by bufio.Writer and returned by Flush.
+			w.w.WriteByte(w.cur)
+			w.cur, w.nbits = 0, 0
+		}
+	}
+}
+
+func (w *bitWriter) flush() error {
+	if w.nbits != 0 {
+		w.w.WriteByte(w.cur << (8 - w.nbits))
+		w.cur, w.nbits = 0, 0
+	}
+	return w.w.Flush()
+}
+
+// Compresses data as it is written, keeping only the window and the lookahead in memory.
+// The stream is complete when the writer is closed.
+type heatshrinkWriter struct {
+	bits          bitWriter
+	windowBits    int
+	lookaheadBits int
+	window        int
+	maxLen        int
+	minLen        int
+
+	// Input from position base on, positions are counted from the start of the stream.
+	buf  []byte
+	base int
+	// Next position to encode.
+	pos int
+
+	// Chains of positions with the same first two bytes, the latest first. Previous
+	// positions are kept for the last 2*window ones, older aren't reachable anyway.
+	head []int
+	prev []int
+}
+
+func newHeatshrinkWriter(w io.Writer, windowBits int, lookaheadBits int) *heatshrinkWriter {
+	hw := &heatshrinkWriter{
+		bits:          bitWriter{w: bufio.NewWriter(w)},
+		windowBits:    windowBits,
+		lookaheadBits: lookaheadBits,
+		window:        1 << windowBits,
+		maxLen:        1 << lookaheadBits,
+		// Backreference must be shorter than the literals it replaces.
+		minLen: (1+windowBits+lookaheadBits)/9 + 1,
+		head:   make([]int, 1<<16),
+		prev:   make([]int, 2<<windowBits),
+	}
+	for i := range hw.head {
+		hw.head[i] = -1
+	}
+	return hw
+}
+
+func (w *heatshrinkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	w.encode(false)
+	return len(p), nil
+}
+
+func (w *heatshrinkWriter) Close() error {
+	w.encode(true)
+	return w.bits.flush()
+}
+
+func (w *heatshrinkWriter) at(pos int) byte {
+	return w.buf[pos-w.base]
+}
+
+func (w *heatshrinkWriter) insert(pos int, end int) {
+	if pos+1 < end {
+		key := int(w.at(pos))<<8 | int(w.at(pos+1))
+		w.prev[pos%len(w.prev)] = w.head[key]
+		w.head[key] = pos
+	}
+}
+
+// Encodes positions whose longest possible match is already written, or all of them
+// at the end of the stream.
+func (w *heatshrinkWriter) encode(final bool) {
+	end := w.base + len(w.buf)
+	for w.pos < end && (final || end-w.pos > w.maxLen) {
+		pos := w.pos
+		bestLen, bestDist := 0, 0
+		if pos+1 < end {
+			key := int(w.at(pos))<<8 | int(w.at(pos+1))
+			limit := min(w.maxLen, end-pos)
+			for cand, n := w.head[key], 0; cand >= 0 && pos-cand <= w.window && n < HEATSHRINK_MAX_CHAIN; cand, n = w.prev[cand%len(w.prev)], n+1 {
+				l := matchlen(w.buf[cand-w.base:cand-w.base+limit], w.buf[pos-w.base:pos-w.base+limit])
+				if l > bestLen {
+					bestLen, bestDist = l, pos-cand
+					if l == limit {
+						break
+					}
+				}
+			}
+		}
+
+		if bestLen >= w.minLen {
+			w.bits.write(0, 1)
+			w.bits.write(bestDist-1, w.windowBits)
+			w.bits.write(bestLen-1, w.lookaheadBits)
+		} else {
+			bestLen = 1
+			w.bits.write(1, 1)
+			w.bits.write(int(w.at(pos)), 8)
+		}
+
+		for i := 0; i < bestLen; i++ {
+			w.insert(pos+i, end)
+		}
+		w.pos += bestLen
+	}
+
+	// Input before the window isn't needed anymore.
+	if drop := w.pos - w.window - w.base; drop > len(w.buf)/2 {
+		w.buf = w.buf[:copy(w.buf, w.buf[drop:])]
+		w.base += drop
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Decoder following heatshrink_decoder.c: the window is a ring buffer of zeros
+// initially, the stream ends when there are not enough bits for the next token.
+func heatshrinkDecompress(t *testing.T, data []byte, windowBits int, lookaheadBits int) []byte {
+	t.Helper()
+
+	pos := 0 // in bits
+	read := func(bits int) (int, bool) {
+		if pos+bits > len(data)*8 {
+			return 0, false
+		}
+		value := 0
+		for i := 0; i < bits; i++ {
+			value = value<<1 | int(data[pos/8]>>(7-pos%8)&1)
+			pos++
+		}
+		return value, true
+	}
+
+	mask := 1<<windowBits - 1
+	window := make([]byte, 1<<windowBits)
+	var out []byte
+	emit := func(b byte) {
+		window[len(out)&mask] = b
+		out = append(out, b)
+	}
+
+	for {
+		tag, ok := read(1)
+		if !ok {
+			return out
+		}
+		if tag == 1 {
+			b, ok := read(8)
+			if !ok {
+				return out
+			}
+			emit(byte(b))
+			continue
+		}
+
+		index, ok := read(windowBits)
+		if !ok {
+			return out
+		}
+		count, ok := read(lookaheadBits)
+		if !ok {
+			return out
+		}
+		for i := 0; i <= count; i++ {
+			emit(window[(len(out)-index-1)&mask])
+		}
+	}
+}
+
+func heatshrinkCompress(data []byte, windowBits int, lookaheadBits int) []byte {
+	var buf bytes.Buffer
+	w := newHeatshrinkWriter(&buf, windowBits, lookaheadBits)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestHeatshrinkKnownStream(t *testing.T) {
+	// Literal 'a', then backreference of distance 1 and length 3, padded with zeros.
+	got := heatshrinkCompress([]byte("aaaa"), 8, 4)
+	want := []byte{0xb0, 0x80, 0x08}
+	if !bytes.Equal(got, want) {
+		t.Errorf("heatshrinkCompress(aaaa) = % x, want % x", got, want)
+	}
+}
+
+func TestHeatshrinkRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := randomBytes(r, 20000)
+	firmware := editBytes(r, bytes.Repeat(randomBytes(r, 1500), 20))
+	text := bytes.Repeat([]byte("heatshrink test, "), 2000)
+
+	inputs := map[string][]byte{
+		"empty":    nil,
+		"one byte": {0x42},
+		"zeros":    make([]byte, 10000),
+		"random":   random,
+		"firmware": firmware,
+		"text":     text,
+	}
+	params := [][2]int{{4, 3}, {8, 4}, {10, 5}, {11, 4}, {13, 12}, {15, 14}}
+
+	for name, data := range inputs {
+		for _, p := range params {
+			compressed := heatshrinkCompress(data, p[0], p[1])
+			got := heatshrinkDecompress(t, compressed, p[0], p[1])
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s, window %d, lookahead %d: decompressed %d bytes differ from %d bytes",
+					name, p[0], p[1], len(got), len(data))
+			}
+		}
+	}
+
+	if compressed := heatshrinkCompress(text, 8, 4); len(compressed) > len(text)/4 {
+		t.Errorf("repetitive text compressed only to %d of %d bytes", len(compressed), len(text))
+	}
+}
+
+func TestValidateHeatshrinkParams(t *testing.T) {
+	tests := []struct {
+		window, lookahead int
+		ok                bool
+	}{
+		{4, 3, true},
+		{8, 4, true},
+		{15, 14, true},
+		{3, 2, false},
+		{16, 4, false},
+		{8, 2, false},
+		{8, 8, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateHeatshrinkParams(tt.window, tt.lookahead); (err == nil) != tt.ok {
+			t.Errorf("ValidateHeatshrinkParams(%d, %d) error = %v, want ok = %v", tt.window, tt.lookahead, err, tt.ok)
+		}
+	}
+}
+
+// Output doesn't depend on how the input is split into writes.
+func TestHeatshrinkWriterChunks(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	data := editBytes(r, bytes.Repeat(randomBytes(r, 3000), 30))
+
+	for _, p := range [][2]int{{4, 3}, {8, 4}, {11, 4}, {15, 14}} {
+		want := heatshrinkCompress(data, p[0], p[1])
+		for _, chunk := range []int{1, 7, 100, 4096, 50000} {
+			var buf bytes.Buffer
+			w := newHeatshrinkWriter(&buf, p[0], p[1])
+			for i := 0; i < len(data); i += chunk {
+				w.Write(data[i:min(i+chunk, len(data))])
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("window %d, lookahead %d: %d bytes written by %d differ from %d bytes written at once",
+					p[0], p[1], buf.Len(), chunk, len(want))
+			}
+		}
+	}
+}
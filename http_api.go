@@ -11,8 +11,17 @@ package main
 //	@name						X-Token
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -25,6 +34,9 @@ import (
 type Api struct {
 	firmwareSvc *FirmwareService
 	tokenSvc    *TokenService
+	deviceSvc   *DeviceService
+	updateSvc   *UpdateService
+	rolloutSvc  *RolloutService
 	cfg         *Config
 }
 
@@ -44,33 +56,161 @@ type ApiFirmwareInfoResponse struct {
 	Md5         string   `json:"md5"`
 	Description string   `json:"description"`
 	Size        int      `json:"size"`
+	Channel     Channel  `json:"channel"`
+	Version     string   `json:"version"`
+	Sha256      string   `json:"sha256"`
+	// Ed25519 signature of the raw SHA-256 digest (hex), see GET /firmwares/signing-key
+	Signature    string `json:"signature"`
+	SignatureKid string `json:"signature_kid"`
+	// Signature made by the developer (created_by) in CI (hex), empty if not required
+	DevSignature string `json:"developer_signature"`
+	DevKid       string `json:"developer_kid"`
 }
 
 type ApiFirmwareResponse struct {
-	Info   ApiFirmwareInfoResponse `json:"info"`
-	BinUrl string                  `json:"bin_url"`
+	Info     ApiFirmwareInfoResponse `json:"info"`
+	BinUrl   string                  `json:"bin_url"`
+	Variants []ApiVariantResponse    `json:"variants"`
+	Delta    *ApiDeltaResponse       `json:"delta,omitempty"` // only for the latest firmware, if board's one is known
+}
+
+// Compressed binary, see README for the formats.
+type ApiVariantResponse struct {
+	Encoding Encoding `json:"encoding" enums:"gzip,heatshrink,lzma"`
+	Url      string   `json:"url"`    // bin_url with encoding param, served as is
+	Size     int64    `json:"size"`   // compressed size
+	Sha256   string   `json:"sha256"` // of the compressed data
+}
+
+// Patch from the firmware the board runs, see README for the format.
+type ApiDeltaResponse struct {
+	Url        string `json:"url"`
+	BaseUuid   string `json:"base_uuid"`
+	BaseSha256 string `json:"base_sha256"` // board must check its image against it before patching
+	Size       int64  `json:"size"`
+	Sha256     string `json:"sha256"`
 }
 
 type ApiAddFirmwareInfoRequest struct {
 	RepoName    string   `json:"repo_name" binding:"required"`
+	Version     string   `json:"version" binding:"required" example:"1.2.0-rc.1"`
 	CommitId    string   `json:"commit_id"`
-	Boards      []string `json:"boards" binding:"required,min=1,dive,min=1"`
+	Boards      []string `json:"boards" binding:"required,min=1,unique,dive,min=1"`
 	Description string   `json:"description"`
+	Channel     Channel  `json:"channel" binding:"omitempty,oneof=stable beta dev" enums:"stable,beta,dev" default:"stable"`
+	// Percentage of boards to deliver the firmware to, raise it later with PUT /firmwares/{uuid}/rollout
+	RolloutPercentage *int `json:"rollout_percentage" binding:"omitempty,min=0,max=100" minimum:"0" maximum:"100" default:"100"`
+}
+
+// At least one of the fields is required.
+type ApiRolloutRequest struct {
+	Percentage *int  `json:"percentage" binding:"omitempty,min=0,max=100" minimum:"0" maximum:"100"`
+	Paused     *bool `json:"paused"`
+}
+
+type ApiRolloutResponse struct {
+	FirmwareUuid string `json:"firmware_uuid"`
+	Percentage   int    `json:"percentage"`
+	UpdatedAt    int64  `json:"updated_at"`
+	UpdatedBy    string `json:"updated_by"`
+	Paused       bool   `json:"paused"`
+	PauseReason  string `json:"pause_reason"`
+	PausedAt     int64  `json:"paused_at"` // 0 if not paused
+}
+
+type ApiSubscriptionRequest struct {
+	RepoName string  `json:"repo_name" binding:"required"`
+	Channel  Channel `json:"channel" binding:"required,oneof=stable beta dev" enums:"stable,beta,dev"`
+}
+
+type ApiSubscriptionResponse struct {
+	RepoName string  `json:"repo_name"`
+	Channel  Channel `json:"channel"`
+}
+
+type ApiDeviceCheckinRequest struct {
+	RepoName     string `json:"repo_name" binding:"required"`
+	FirmwareUuid string `json:"firmware_uuid"`
+	CommitId     string `json:"commit_id"`
+	Uptime       int64  `json:"uptime" binding:"min=0"`
+	ResetReason  string `json:"reset_reason"`
+}
+
+type ApiDeviceResponse struct {
+	Name          string `json:"name"`
+	RepoName      string `json:"repo_name"`
+	FirmwareUuid  string `json:"firmware_uuid"`
+	CommitId      string `json:"commit_id"`
+	Uptime        int64  `json:"uptime"`
+	ResetReason   string `json:"reset_reason"`
+	LastCheckinAt int64  `json:"last_checkin_at"`
+}
+
+type ApiUpdateEventRequest struct {
+	Status    UpdateStatus `json:"status" binding:"required,oneof=downloading installed booted rolled_back failed" enums:"downloading,installed,booted,rolled_back,failed"`
+	ErrorCode string       `json:"error_code"`
+}
+
+type ApiUpdateStatsResponse struct {
+	FirmwareUuid string         `json:"firmware_uuid"`
+	Devices      int            `json:"devices"`
+	Downloading  int            `json:"downloading"`
+	Installed    int            `json:"installed"`
+	Booted       int            `json:"booted"`
+	RolledBack   int            `json:"rolled_back"`
+	Failed       int            `json:"failed"`
+	ErrorCodes   map[string]int `json:"error_codes"`
+}
+
+type ApiCreateUploadRequest struct {
+	Size   int64  `json:"size" binding:"required,min=1"`
+	Md5    string `json:"md5" binding:"omitempty,len=32,hexadecimal"`
+	Sha256 string `json:"sha256" binding:"omitempty,len=64,hexadecimal"`
+}
+
+type ApiUploadResponse struct {
+	Id           string `json:"id"`
+	FirmwareUuid string `json:"firmware_uuid"`
+	Offset       int64  `json:"offset"` // number of bytes uploaded
+	Size         int64  `json:"size"`
+	Md5          string `json:"md5"`
+	Sha256       string `json:"sha256"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type ApiFirmwareSigningKeyResponse struct {
+	Kid       string `json:"kid"`
+	Alg       string `json:"alg" example:"Ed25519"`
+	PublicKey string `json:"public_key"` // PKIX PEM
 }
 
 type ApiUserResponse struct {
-	Name    string `json:"name"`
-	IsBoard bool   `json:"is_board"`
+	Name    string   `json:"name"`
+	IsBoard bool     `json:"is_board"`
+	Scopes  []string `json:"scopes"`
 }
 
 func (api *Api) newFirmwareResponse(info *FirmwareInfo) ApiFirmwareResponse {
 	var binUrl string
 	if info.hasBin() {
 		binUrl = fmt.Sprintf("%s/api/v1/bin/%s", api.cfg.host, info.Uuid)
+		if query := api.tokenSvc.SignBinUrl(info.Uuid); query != nil {
+			binUrl += "?" + query.Encode()
+		}
 	} else {
 		binUrl = ""
 	}
 
+	variants := []ApiVariantResponse{}
+	for _, v := range info.Variants {
+		variants = append(variants, ApiVariantResponse{
+			v.Encoding,
+			variantUrl(binUrl, v.Encoding),
+			v.Size,
+			v.Sha256,
+		})
+	}
+
 	return ApiFirmwareResponse{
 		ApiFirmwareInfoResponse{
 			info.Id,
@@ -83,12 +223,51 @@ func (api *Api) newFirmwareResponse(info *FirmwareInfo) ApiFirmwareResponse {
 			info.Md5,
 			info.Description,
 			info.Size,
+			info.Channel,
+			info.Version,
+			info.Sha256,
+			info.Signature,
+			info.SignatureKid,
+			info.DevSignature,
+			info.DevKid,
 		},
 		binUrl,
+		variants,
+		nil,
+	}
+}
+
+// Encoding param is not signed, all variants of the binary are allowed by the same signature.
+func variantUrl(binUrl string, encoding Encoding) string {
+	sep := "?"
+	if strings.Contains(binUrl, "?") {
+		sep = "&"
+	}
+	return binUrl + sep + "encoding=" + string(encoding)
+}
+
+func (api *Api) newDeltaResponse(info *FirmwareInfo, base *FirmwareInfo, d *Delta) *ApiDeltaResponse {
+	path := deltaBinPath(info.Uuid, base.Uuid)
+	deltaUrl := fmt.Sprintf("%s/api/v1/bin/%s", api.cfg.host, path)
+	if query := api.tokenSvc.SignBinUrl(path); query != nil {
+		deltaUrl += "?" + query.Encode()
 	}
+
+	return &ApiDeltaResponse{
+		deltaUrl,
+		base.Uuid,
+		base.Sha256,
+		d.Size,
+		d.Sha256,
+	}
+}
+
+// Path of the patch under /bin/, signed URLs are bound to it.
+func deltaBinPath(uuid string, baseUuid string) string {
+	return fmt.Sprintf("%s/deltas/%s", uuid, baseUuid)
 }
 
-func (api *Api) auth(c *gin.Context, constraints *TokenSubject) (*TokenSubject, bool) {
+func (api *Api) auth(c *gin.Context) (*TokenSubject, bool) {
 	token := c.GetHeader("X-Token")
 	subject, err := api.tokenSvc.ParseToken(token)
 	if err != nil {
@@ -99,37 +278,100 @@ func (api *Api) auth(c *gin.Context, constraints *TokenSubject) (*TokenSubject,
 		return nil, false
 	}
 
-	if constraints != nil && constraints.isBoard != subject.isBoard {
-		c.JSON(http.StatusForbidden, HttpError{
-			http.StatusForbidden,
-			"access denied",
+	return subject, true
+}
+
+// Writes 404 if there is no firmware with uuid from the path.
+func (api *Api) firmwareFromPath(c *gin.Context) (*FirmwareInfo, bool) {
+	info, err := api.firmwareSvc.GetFirmwareInfo(c.Param("uuid"))
+	if err != nil {
+		panic(err)
+	}
+
+	if info == nil {
+		c.JSON(http.StatusNotFound, HttpError{
+			http.StatusNotFound,
+			"firmware not found",
 		})
 		return nil, false
 	}
 
-	return subject, true
+	return info, true
+}
+
+func (api *Api) denyAccess(c *gin.Context) {
+	c.JSON(http.StatusForbidden, HttpError{
+		http.StatusForbidden,
+		"access denied",
+	})
+}
+
+func (api *Api) authorize(c *gin.Context, subject *TokenSubject, perm Permission, repo string) bool {
+	if !subject.can(perm, repo) {
+		api.denyAccess(c)
+		return false
+	}
+
+	return true
 }
 
 // getLatestFirmware godoc
 //
 //	@Summary	Get latest firmware version
 //	@Schemes
-//	@Description	Get latest firmware version for given repo and tags. Only for boards
+//	@Description	Get firmware with the highest semantic version for given repo and tags. Requires board:{repo} scope.
+//	@Description	Releases from the channel board is subscribed to (stable by default) and more stable ones are considered.
+//	@Description	Board may pass firmware it runs (current_uuid, current_version or If-None-Match with ETag
+//	@Description	from the previous response), then 304 without body is returned if it is still the latest one,
+//	@Description	otherwise the response contains a patch from it, if there is one
 //	@Produce		json
-//	@Param			repo	query		string				false	"name of firmware's repo"
-//	@Success		200		{object}	ApiFirmwareResponse	"ok"
-//	@Failure		401		{object}	HttpError			"Invalid auth token"
-//	@Failure		403		{object}	HttpError			"Access is denied"
-//	@Failure		404		{object}	HttpError			"no firmware found for this board in repo"
+//	@Param			repo			query		string				false	"name of firmware's repo"
+//	@Param			channel			query		string				false	"override board's channel"	Enums(stable, beta, dev)
+//	@Param			current_uuid	query		string				false	"UUID of firmware the board runs"
+//	@Param			current_version	query		string				false	"version of firmware the board runs"
+//	@Param			If-None-Match	header		string				false	"ETag of firmware the board runs"
+//	@Success		200				{object}	ApiFirmwareResponse	"ok"
+//	@Header			200				{string}	ETag				"firmware ETag for If-None-Match"
+//	@Success		304				"board runs the latest firmware"
+//	@Failure		400				{object}	HttpError			"Unknown channel/invalid version"
+//	@Failure		401				{object}	HttpError			"Invalid auth token"
+//	@Failure		403				{object}	HttpError			"Access is denied"
+//	@Failure		404				{object}	HttpError			"no firmware found for this board in repo"
 //	@Security		ApiKeyAuth
 //	@Router			/firmwares/latest [get]
 func (api *Api) getLatestFirmware(c *gin.Context) {
-	subject, ok := api.auth(c, &TokenSubject{isBoard: true})
+	subject, ok := api.auth(c)
 	if !ok {
 		return
 	}
 
-	fi, err := api.firmwareSvc.GetLatestFirmware(c.Query("repo"), subject.name)
+	repo := c.Query("repo")
+	if !api.authorize(c, subject, PermBoard, repo) {
+		return
+	}
+
+	channel := Channel(c.Query("channel"))
+	if channel != "" && !slices.Contains(CHANNELS, channel) {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			"unknown channel",
+		})
+		return
+	}
+
+	var currentVersion *Version
+	if v := c.Query("current_version"); v != "" {
+		var err error
+		if currentVersion, err = ParseVersion(v); err != nil {
+			c.JSON(http.StatusBadRequest, HttpError{
+				http.StatusBadRequest,
+				err.Error(),
+			})
+			return
+		}
+	}
+
+	fi, err := api.firmwareSvc.GetLatestFirmware(repo, subject.name, channel)
 	if err != nil {
 		panic(err)
 	}
@@ -142,36 +384,252 @@ func (api *Api) getLatestFirmware(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, api.newFirmwareResponse(fi))
+	c.Header("ETag", firmwareEtag(fi))
+	c.Header("Cache-Control", "no-cache")
+
+	if c.Query("current_uuid") == fi.Uuid ||
+		currentVersion != nil && currentVersion.key() == fi.VersionKey ||
+		etagMatches(c.GetHeader("If-None-Match"), fi) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	resp := api.newFirmwareResponse(fi)
+	d, base, err := api.firmwareSvc.GetDelta(fi, c.Query("current_uuid"), currentVersion)
+	if err != nil {
+		panic(err)
+	}
+	if d != nil {
+		resp.Delta = api.newDeltaResponse(fi, base, d)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Weak, because response body also contains signed bin_url, which changes.
+func firmwareEtag(fi *FirmwareInfo) string {
+	return fmt.Sprintf(`W/"%s"`, fi.Uuid)
+}
+
+// Strong ETag of the firmware binary, the file never changes once uploaded.
+func binEtag(fi *FirmwareInfo) string {
+	if fi.Sha256 == "" {
+		return fmt.Sprintf(`"%s"`, fi.Md5)
+	}
+	return fmt.Sprintf(`"%s"`, fi.Sha256)
+}
+
+// Picks the variant most preferred by Accept-Encoding header (RFC 9110), nil means the raw binary.
+// Among equally preferred ones the smallest is chosen. Only CONTENT_CODINGS are considered.
+func acceptedVariant(acceptEncoding string, variants []Variant) *Variant {
+	qs := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		qs[name] = q
+	}
+
+	var best *Variant
+	bestQ := 0.0
+	for i := range variants {
+		if !slices.Contains(CONTENT_CODINGS, variants[i].Encoding) {
+			continue
+		}
+		q, ok := qs[string(variants[i].Encoding)]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ || (q == bestQ && best != nil && variants[i].Size < best.Size) {
+			best, bestQ = &variants[i], q
+		}
+	}
+
+	if identity, ok := qs["identity"]; best != nil && ok && identity > bestQ {
+		return nil
+	}
+	return best
+}
+
+// Reads digests of the uploaded file the client expects from request headers.
+func expectedDigests(c *gin.Context) (ExpectedDigests, error) {
+	d := ExpectedDigests{
+		Md5:    c.GetHeader("X-Checksum-Md5"),
+		Sha256: c.GetHeader("X-Checksum-Sha256"),
+	}
+	if d.Md5 != "" && !isHexDigest(d.Md5, md5.Size) {
+		return d, errors.New("invalid X-Checksum-Md5 header, hex encoded MD5 expected")
+	}
+	if d.Sha256 != "" && !isHexDigest(d.Sha256, sha256.Size) {
+		return d, errors.New("invalid X-Checksum-Sha256 header, hex encoded SHA-256 expected")
+	}
+	return d, nil
+}
+
+// Reads base64 encoded detached signature made by the developer, nil if there is none.
+func developerSignature(c *gin.Context) ([]byte, error) {
+	header := c.GetHeader("X-Firmware-Signature")
+	if header == "" {
+		return nil, nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, errors.New("invalid X-Firmware-Signature header, base64 encoded signature expected")
+	}
+	return signature, nil
+}
+
+func isHexDigest(s string, size int) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == size
+}
+
+// Compares If-None-Match header value with firmware ETag using weak comparison.
+// "*" doesn't match, it would tell a board with any firmware there is no update.
+func etagMatches(ifNoneMatch string, fi *FirmwareInfo) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+		if tag == fi.Uuid {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	FIRMWARES_PAGE_DEFAULT = 100
+	FIRMWARES_PAGE_MAX     = 1000
+)
+
+// Parses filters of GET /firmwares, except repo which depends on the subject.
+func firmwareFilterFromQuery(c *gin.Context) (*FirmwareFilter, error) {
+	filter := &FirmwareFilter{
+		Board:        c.Query("board"),
+		CreatedBy:    c.Query("created_by"),
+		CommitPrefix: c.Query("commit"),
+	}
+
+	for param, t := range map[string]*time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s", param)
+		}
+		*t = time.Unix(seconds, 0).UTC()
+	}
+
+	if value := c.Query("has_binary"); value != "" {
+		hasBinary, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("invalid has_binary")
+		}
+		filter.HasBinary = &hasBinary
+	}
+	return filter, nil
 }
 
 // getAllFirmwares godoc
 //
-//	@Summary	Get all firmwares
+//	@Summary	Get firmwares
 //	@Schemes
-//	@Description	Get all firmwares. Only for non-board users
+//	@Description	Get a page of firmwares from repos the user has read:{repo} scope for, sorted by repo and version (descending) by default.
+//	@Description	Cursor of the next page is returned in X-Next-Cursor header, absent on the last page.
+//	@Description	Pass it as cursor with the same filters and sort to get the next page
 //	@Produce		json
-//	@Success		200	{array}		ApiFirmwareResponse	"ok"
-//	@Failure		401	{object}	HttpError			"Invalid auth token"
-//	@Failure		403	{object}	HttpError			"Access is denied"
+//	@Param			repo			query		string				false	"name of firmware's repo"
+//	@Param			board			query		string				false	"firmwares for the board only"
+//	@Param			created_by		query		string				false	"token subject the firmware was created by"
+//	@Param			commit			query		string				false	"prefix of commit id"
+//	@Param			created_after	query		int					false	"unix time, inclusive"
+//	@Param			created_before	query		int					false	"unix time, exclusive"
+//	@Param			has_binary		query		bool				false	"whether binary file is uploaded"
+//	@Param			sort			query		string				false	"sort order, version is sorted within repo"	Enums(-version, version, -created_at, created_at)	default(-version)
+//	@Param			limit			query		int					false	"page size"	minimum(1)	maximum(1000)	default(100)
+//	@Param			cursor			query		string				false	"X-Next-Cursor of the previous page"
+//	@Success		200				{array}		ApiFirmwareResponse	"ok"
+//	@Header			200				{string}	X-Next-Cursor		"cursor of the next page"
+//	@Failure		400				{object}	HttpError			"Invalid query params"
+//	@Failure		401				{object}	HttpError			"Invalid auth token"
+//	@Failure		403				{object}	HttpError			"Access is denied"
 //	@Security		ApiKeyAuth
 //	@Router			/firmwares [get]
 func (api *Api) getAllFirmwares(c *gin.Context) {
-	_, ok := api.auth(c, &TokenSubject{isBoard: false})
+	subject, ok := api.auth(c)
 	if !ok {
 		return
 	}
 
-	fis, err := api.firmwareSvc.GetAllFirmwaresInfo()
+	if !subject.canAny(PermRead) {
+		api.denyAccess(c)
+		return
+	}
+
+	filter, err := firmwareFilterFromQuery(c)
 	if err != nil {
-		panic(err)
+		c.JSON(http.StatusBadRequest, HttpError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	if repo := c.Query("repo"); repo != "" {
+		if !api.authorize(c, subject, PermRead, repo) {
+			return
+		}
+		filter.Repos = []string{repo}
+	} else {
+		filter.Repos = subject.reposWith(PermRead)
+	}
+
+	sort := FirmwareSort(c.DefaultQuery("sort", string(SortVersionDesc)))
+	if !slices.Contains(FIRMWARE_SORTS, sort) {
+		c.JSON(http.StatusBadRequest, HttpError{http.StatusBadRequest, "invalid sort"})
+		return
+	}
+
+	limit := FIRMWARES_PAGE_DEFAULT
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > FIRMWARES_PAGE_MAX {
+			c.JSON(http.StatusBadRequest, HttpError{http.StatusBadRequest, "invalid limit"})
+			return
+		}
+	}
+
+	fis, next, err := api.firmwareSvc.ListFirmwares(filter, sort, c.Query("cursor"), limit)
+	if err != nil {
+		switch err.(type) {
+		case *InvalidCursorError:
+			c.JSON(http.StatusBadRequest, HttpError{http.StatusBadRequest, err.Error()})
+			return
+		default:
+			panic(err)
+		}
 	}
 
-	firmwares := []ApiFirmwareResponse{}
-	for _, fi := range fis {
-		firmwares = append(firmwares, api.newFirmwareResponse(&fi))
+	firmwares := make([]ApiFirmwareResponse, len(fis))
+	for i := range fis {
+		firmwares[i] = api.newFirmwareResponse(&fis[i])
 	}
 
+	if next != "" {
+		c.Header("X-Next-Cursor", next)
+	}
 	c.JSON(http.StatusOK, firmwares)
 }
 
@@ -180,16 +638,19 @@ func (api *Api) getAllFirmwares(c *gin.Context) {
 //	@Summary	Create firmware record in db
 //	@Schemes
 //	@Accept			json
-//	@Description	Create firmare record in db. Upload file to POST /bin/{uuid} after. Only for non-board users
+//	@Description	Create firmare record in db. Upload file to POST /bin/{uuid} after.
+//	@Description	Version must be a semantic version unique in the repo. Requires upload:{repo} scope
 //	@Produce		json
 //	@Param			firmware	body		ApiAddFirmwareInfoRequest	true	"firmware info"
 //	@Success		201			{object}	ApiFirmwareResponse			"ok"
+//	@Failure		400			{object}	HttpError					"Invalid firmware info"
 //	@Failure		401			{object}	HttpError					"Invalid auth token"
 //	@Failure		403			{object}	HttpError					"Access is denied"
+//	@Failure		409			{object}	HttpError					"Version already exists in repo"
 //	@Security		ApiKeyAuth
 //	@Router			/firmwares [post]
 func (api *Api) addFirmware(c *gin.Context) {
-	subject, ok := api.auth(c, &TokenSubject{isBoard: false})
+	subject, ok := api.auth(c)
 	if !ok {
 		return
 	}
@@ -203,6 +664,10 @@ func (api *Api) addFirmware(c *gin.Context) {
 		return
 	}
 
+	if !api.authorize(c, subject, PermUpload, json.RepoName) {
+		return
+	}
+
 	info := FirmwareInfo{
 		RepoName:    json.RepoName,
 		CommitId:    json.CommitId,
@@ -210,17 +675,27 @@ func (api *Api) addFirmware(c *gin.Context) {
 		CreatedAt:   time.Now(),
 		CreatedBy:   subject.name,
 		Description: json.Description,
+		Channel:     json.Channel,
+		Version:     json.Version,
+
+		RolloutPercentage: json.RolloutPercentage,
 	}
 
 	addedInfo, err := api.firmwareSvc.CreateFirmware(&info)
 	if err != nil {
 		switch err.(type) {
-		case *Md5DiffersError:
+		case *InvalidVersionError:
 			c.JSON(http.StatusBadRequest, HttpError{
 				http.StatusBadRequest,
 				err.Error(),
 			})
 			return
+		case *VersionAlreadyExistsError:
+			c.JSON(http.StatusConflict, HttpError{
+				http.StatusConflict,
+				err.Error(),
+			})
+			return
 		default:
 			panic(err)
 		}
@@ -233,102 +708,343 @@ func (api *Api) addFirmware(c *gin.Context) {
 //
 //	@Summary	Get binary file
 //	@Schemes
-//	@Description	Get binary firmware file with given uuid. Available for all authenticated users
-//	@Param			uuid	path		string true	"firmware's UUID"
-//	@Success		200		{file}		file
-//	@Failure		401		{object}	HttpError	"Invalid auth token"
-//	@Failure		404		{object}	HttpError	"firmware not found"
+//	@Description	Get binary firmware file with given uuid. Requires either X-Token with read:{repo} or board:{repo} scope,
+//	@Description	or expires and signature params of the signed bin_url from firmware response.
+//	@Description	Supports Range and If-Range headers to resume interrupted downloads.
+//	@Description	Compressed variant is served as is if requested by encoding param,
+//	@Description	gzip variant is also served with Content-Encoding if accepted by Accept-Encoding header
+//	@Param			uuid			path		string	true	"firmware's UUID"
+//	@Param			expires			query		int		false	"signed URL expiration time (unix)"
+//	@Param			signature		query		string	false	"signed URL signature"
+//	@Param			encoding		query		string	false	"compressed variant to download"	Enums(identity, gzip, heatshrink, lzma)
+//	@Param			Accept-Encoding	header		string	false	"only gzip is negotiated, e.g. gzip;q=0.5"
+//	@Param			Range			header		string	false	"byte range, e.g. bytes=1024-"
+//	@Param			If-Range		header		string	false	"ETag of the file, Range is ignored if it doesn't match"
+//	@Success		200				{file}		file
+//	@Success		206				{file}		file
+//	@Success		307				"redirect to presigned storage URL (s3.presignDownloads)"
+//	@Header			200,206			{string}	ETag				"strong ETag of the file"
+//	@Header			200,206			{string}	Accept-Ranges		"bytes"
+//	@Header			200,206			{string}	Content-Encoding	"encoding of the variant chosen by Accept-Encoding"
+//	@Failure		400				{object}	HttpError	"unsupported encoding"
+//	@Failure		401				{object}	HttpError	"Invalid auth token"
+//	@Failure		403				{object}	HttpError	"Access is denied/invalid or expired URL signature"
+//	@Failure		404				{object}	HttpError	"firmware/variant not found"
+//	@Failure		416				"Range not satisfiable"
+//	@Failure		500				{object}	HttpError	"stored file is missing"
 //	@Security		ApiKeyAuth
 //	@Router			/bin/{uuid} [get]
 func (api *Api) getFirmwareBinary(c *gin.Context) {
-	// _, ok := api.auth(c, nil)
-	// if !ok {
-		// return
-	// }
+	uuid := c.Param("uuid")
+
+	subject, ok := api.binDownloadSubject(c, uuid)
+	if !ok {
+		return
+	}
+
+	info, ok := api.downloadableFirmware(c, uuid, subject)
+	if !ok {
+		return
+	}
+
+	var variant *Variant
+	// Storage would send variant chosen by Accept-Encoding without Content-Encoding.
+	redirect := true
+	if encoding, ok := c.GetQuery("encoding"); ok && encoding != "identity" {
+		if !slices.Contains(ENCODINGS, Encoding(encoding)) {
+			c.JSON(http.StatusBadRequest, HttpError{
+				http.StatusBadRequest,
+				(&UnsupportedEncodingError{encoding}).Error(),
+			})
+			return
+		}
+
+		variant = info.variant(Encoding(encoding))
+		if variant == nil {
+			c.JSON(http.StatusNotFound, HttpError{
+				http.StatusNotFound,
+				"variant not found",
+			})
+			return
+		}
+	} else if !ok {
+		c.Header("Vary", "Accept-Encoding")
+		variant = acceptedVariant(c.GetHeader("Accept-Encoding"), info.Variants)
+		if variant != nil {
+			c.Header("Content-Encoding", string(variant.Encoding))
+			redirect = false
+		}
+	}
+
+	if variant != nil {
+		api.sendStoredFile(c, api.firmwareSvc.GetVariantFile(info, variant), fmt.Sprintf(`"%s"`, variant.Sha256), redirect)
+	} else {
+		api.sendStoredFile(c, api.firmwareSvc.GetBinaryFile(info), binEtag(info), redirect)
+	}
+}
+
+// Redirects to presigned URL of the file if storage gives one and redirect is allowed,
+// otherwise sends the file. Whole file is checked against its SHA-256 on the way.
+func (api *Api) sendStoredFile(c *gin.Context, f StoredFile, etag string, redirect bool) {
+	if redirect {
+		url, err := api.firmwareSvc.GetPresignedUrl(f)
+		if err != nil {
+			panic(err)
+		}
+		if url != "" {
+			c.Redirect(http.StatusTemporaryRedirect, url)
+			return
+		}
+	}
+
+	r, err := api.firmwareSvc.OpenFile(f)
+	if err != nil {
+		switch err.(type) {
+		case *CorruptedFileError:
+			c.JSON(http.StatusInternalServerError, HttpError{
+				http.StatusInternalServerError,
+				err.Error(),
+			})
+			return
+		default:
+			panic(err)
+		}
+	}
+	defer r.Close()
+
+	// ServeContent handles Range, If-Range and conditional headers using the ETag set here
+	c.Header("ETag", etag)
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Writer, c.Request, "", time.Time{}, r)
+}
+
+// Authorizes download of the file with given path under /bin/ either by signed URL params or by X-Token.
+// Subject is nil for signed URLs, otherwise it must be checked against the firmware's repo.
+func (api *Api) binDownloadSubject(c *gin.Context, path string) (*TokenSubject, bool) {
+	signature, signed := c.GetQuery("signature")
+	if !signed {
+		return api.auth(c)
+	}
+
+	if err := api.tokenSvc.VerifyBinUrl(path, c.Query("expires"), signature); err != nil {
+		c.JSON(http.StatusForbidden, HttpError{
+			http.StatusForbidden,
+			err.Error(),
+		})
+		return nil, false
+	}
+
+	return nil, true
+}
 
-	path, err := api.firmwareSvc.GetFirmwareBinaryPath(c.Param("uuid"))
+// Writes 404 if firmware has no binary and 403 if subject can't download it.
+func (api *Api) downloadableFirmware(c *gin.Context, uuid string, subject *TokenSubject) (*FirmwareInfo, bool) {
+	info, err := api.firmwareSvc.GetFirmwareInfo(uuid)
 	if err != nil {
 		panic(err)
 	}
 
-	if path == "" {
+	if info == nil || !info.hasBin() {
 		c.JSON(http.StatusNotFound, HttpError{
 			http.StatusNotFound,
 			"firmware not found",
 		})
+		return nil, false
 	}
 
-	c.File(path)
+	if subject != nil && !subject.can(PermRead, info.RepoName) && !subject.can(PermBoard, info.RepoName) {
+		api.denyAccess(c)
+		return nil, false
+	}
+
+	return info, true
 }
 
-// getAuthenticatedUser godoc
+// getFirmwareDelta godoc
 //
-//	@Summary	Get authenticated user
+//	@Summary	Get patch
 //	@Schemes
-//	@Produce		json
-//	@Description	Get authenticated user
-//	@Success		200	{object}	ApiUserResponse	"ok"
-//	@Failure		401	{object}	HttpError		"Invalid auth token"
+//	@Description	Get patch from the base firmware binary to the firmware binary (the URL is given by /firmwares/latest).
+//	@Description	Requires either X-Token with read:{repo} or board:{repo} scope, or signed URL params.
+//	@Description	Supports Range and If-Range headers to resume interrupted downloads
+//	@Param			uuid		path		string	true	"firmware's UUID"
+//	@Param			base		path		string	true	"base firmware's UUID"
+//	@Param			expires		query		int		false	"signed URL expiration time (unix)"
+//	@Param			signature	query		string	false	"signed URL signature"
+//	@Param			Range		header		string	false	"byte range, e.g. bytes=1024-"
+//	@Param			If-Range	header		string	false	"ETag of the file, Range is ignored if it doesn't match"
+//	@Success		200			{file}		file
+//	@Success		206			{file}		file
+//	@Success		307			"redirect to presigned storage URL (s3.presignDownloads)"
+//	@Header			200,206		{string}	ETag			"strong ETag of the file"
+//	@Failure		401			{object}	HttpError	"Invalid auth token"
+//	@Failure		403			{object}	HttpError	"Access is denied/invalid or expired URL signature"
+//	@Failure		404			{object}	HttpError	"firmware/patch not found"
+//	@Failure		416			"Range not satisfiable"
+//	@Failure		500			{object}	HttpError	"stored file is missing"
 //	@Security		ApiKeyAuth
-//	@Router			/users/me [get]
-func (api *Api) getAuthenticatedUser(c *gin.Context) {
-	subj, ok := api.auth(c, nil)
+//	@Router			/bin/{uuid}/deltas/{base} [get]
+func (api *Api) getFirmwareDelta(c *gin.Context) {
+	uuid := c.Param("uuid")
+
+	subject, ok := api.binDownloadSubject(c, deltaBinPath(uuid, c.Param("base")))
 	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, ApiUserResponse{
-		subj.name,
-		subj.isBoard,
-	})
-}
-
-// addFirmwareBinary godoc
-//
-//	@Schemes
-//	@Produce		json
-//	@Summary		Upload firmware binary file
-//	@Description	Upload firmware binary file. Only for non-board users
-//	@Accept			multipart/form-data
-//	@Param			uuid	path		string  true	"firmware's UUID"
-//	@Param			file	formData	file	true	"firmware binary file"
-//	@Success		204
-//	@Failure		400	{object}	HttpError	"File is already uploaded/empty file provided"
-//	@Failure		401	{object}	HttpError	"Invalid auth token"
-//	@Failure		403	{object}	HttpError	"Access denied"
-//	@Failure		404	{object}	HttpError	"Firmware not found"
-//	@Security		ApiKeyAuth
-//	@Router			/bin/{uuid} [post]
-func (api *Api) addFirmwareBinary(c *gin.Context) {
-	_, ok := api.auth(c, &TokenSubject{isBoard: false})
+	info, ok := api.downloadableFirmware(c, uuid, subject)
 	if !ok {
 		return
 	}
 
-	fh, err := c.FormFile("file")
+	d, base, err := api.firmwareSvc.GetDelta(info, c.Param("base"), nil)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, HttpError{
-			http.StatusBadRequest,
+		panic(err)
+	}
+
+	if d == nil {
+		c.JSON(http.StatusNotFound, HttpError{
+			http.StatusNotFound,
+			"patch not found",
+		})
+		return
+	}
+
+	api.sendStoredFile(c, api.firmwareSvc.GetDeltaFile(info, base, d), fmt.Sprintf(`"%s"`, d.Sha256), true)
+}
+
+// getFirmwareSigningKey godoc
+//
+//	@Summary	Get firmware signing key
+//	@Schemes
+//	@Produce		json
+//	@Description	Get public key that firmware binaries are signed with.
+//	@Description	The signature in firmware info is made over the raw 32 byte SHA-256 digest of the binary
+//	@Success		200	{object}	ApiFirmwareSigningKeyResponse	"ok"
+//	@Failure		401	{object}	HttpError						"Invalid auth token"
+//	@Security		ApiKeyAuth
+//	@Router			/firmwares/signing-key [get]
+func (api *Api) getFirmwareSigningKey(c *gin.Context) {
+	if _, ok := api.auth(c); !ok {
+		return
+	}
+
+	signer := api.firmwareSvc.GetSigner()
+	publicKey, err := signer.PublicKeyPem()
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(http.StatusOK, ApiFirmwareSigningKeyResponse{
+		signer.Kid(),
+		"Ed25519",
+		publicKey,
+	})
+}
+
+// getAuthenticatedUser godoc
+//
+//	@Summary	Get authenticated user
+//	@Schemes
+//	@Produce		json
+//	@Description	Get authenticated user
+//	@Success		200	{object}	ApiUserResponse	"ok"
+//	@Failure		401	{object}	HttpError		"Invalid auth token"
+//	@Security		ApiKeyAuth
+//	@Router			/users/me [get]
+func (api *Api) getAuthenticatedUser(c *gin.Context) {
+	subj, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	scopes := []string{}
+	for _, scope := range subj.scopes {
+		scopes = append(scopes, scope.String())
+	}
+
+	c.JSON(http.StatusOK, ApiUserResponse{
+		subj.name,
+		subj.isBoard(),
+		scopes,
+	})
+}
+
+// addFirmwareBinary godoc
+//
+//	@Schemes
+//	@Produce		json
+//	@Summary		Upload firmware binary file
+//	@Description	Upload firmware binary file either as "file" field of multipart form or as raw request body
+//	@Description	with application/octet-stream content type. Requires upload:{repo} scope
+//	@Accept			multipart/form-data
+//	@Accept			application/octet-stream
+//	@Description	Upload is rejected if the file doesn't match digests given in X-Checksum-* headers
+//	@Description	or if it isn't signed by a registered key of the developer the firmware is created by
+//	@Param			uuid					path		string  true	"firmware's UUID"
+//	@Param			file					formData	file	true	"firmware binary file"
+//	@Param			X-Checksum-Md5			header		string	false	"expected MD5 of the file (hex)"
+//	@Param			X-Checksum-Sha256		header		string	false	"expected SHA-256 of the file (hex)"
+//	@Param			X-Firmware-Signature	header		string	false	"developer's signature of the file SHA-256 (base64)"
+//	@Success		204
+//	@Failure		400	{object}	HttpError	"File is already uploaded/empty file provided/digest differs/invalid signature"
+//	@Failure		401	{object}	HttpError	"Invalid auth token"
+//	@Failure		403	{object}	HttpError	"Access denied"
+//	@Failure		404	{object}	HttpError	"Firmware not found"
+//	@Security		ApiKeyAuth
+//	@Router			/bin/{uuid} [post]
+func (api *Api) addFirmwareBinary(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	info, ok := api.firmwareFromPath(c)
+	if !ok {
+		return
+	}
+
+	if !api.authorize(c, subject, PermUpload, info.RepoName) {
+		return
+	}
+
+	if info.hasBin() {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			"file is already uploaded",
+		})
+		return
+	}
+
+	expected, err := expectedDigests(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
 			err.Error(),
 		})
+		return
 	}
 
-	if fh.Size == 0 {
+	signature, err := developerSignature(c)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, HttpError{
 			http.StatusBadRequest,
-			"empty file is not allowed",
+			err.Error(),
 		})
 		return
 	}
 
-	f, err := fh.Open()
+	file, err := uploadedFile(c)
 	if err != nil {
-		panic(err)
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			err.Error(),
+		})
+		return
 	}
 
-	bytes := make([]byte, fh.Size)
-	f.Read(bytes)
-	if err := api.firmwareSvc.AddFirmwareFile(c.Param("uuid"), bytes); err != nil {
+	if err := api.firmwareSvc.AddFirmwareFile(info.Uuid, file, expected, signature); err != nil {
 		switch err.(type) {
 		case *FirmwareNotFoundError:
 			c.JSON(http.StatusNotFound, HttpError{
@@ -342,6 +1058,13 @@ func (api *Api) addFirmwareBinary(c *gin.Context) {
 				"file is already uploaded",
 			})
 			return
+		case *EmptyFirmwareFileError, *Md5DiffersError, *Sha256DiffersError,
+			*MissingDeveloperSignatureError, *InvalidDeveloperSignatureError:
+			c.JSON(http.StatusBadRequest, HttpError{
+				http.StatusBadRequest,
+				err.Error(),
+			})
+			return
 		default:
 			panic(err)
 		}
@@ -350,16 +1073,736 @@ func (api *Api) addFirmwareBinary(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
 
+// deviceCheckin godoc
+//
+//	@Summary	Report board state
+//	@Schemes
+//	@Accept			json
+//	@Description	Report firmware the board is running, its uptime (seconds) and last reset reason.
+//	@Description	Board is identified by token subject. Requires board:{repo} scope
+//	@Param			state	body	ApiDeviceCheckinRequest	true	"board state"
+//	@Success		204
+//	@Failure		400	{object}	HttpError	"Invalid board state"
+//	@Failure		401	{object}	HttpError	"Invalid auth token"
+//	@Failure		403	{object}	HttpError	"Access is denied"
+//	@Security		ApiKeyAuth
+//	@Router			/devices/checkin [post]
+func (api *Api) deviceCheckin(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	var json ApiDeviceCheckinRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			err.Error(),
+		})
+		return
+	}
+
+	if !api.authorize(c, subject, PermBoard, json.RepoName) {
+		return
+	}
+
+	err := api.deviceSvc.Checkin(&DeviceInfo{
+		Name:         subject.name,
+		RepoName:     json.RepoName,
+		FirmwareUuid: json.FirmwareUuid,
+		CommitId:     json.CommitId,
+		Uptime:       json.Uptime,
+		ResetReason:  json.ResetReason,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// getAllDevices godoc
+//
+//	@Summary	Get all devices
+//	@Schemes
+//	@Description	Get last reported state of all boards from repos the user has read:{repo} scope for,
+//	@Description	a board checking in for several repos is listed for each of them
+//	@Produce		json
+//	@Success		200	{array}		ApiDeviceResponse	"ok"
+//	@Failure		401	{object}	HttpError			"Invalid auth token"
+//	@Failure		403	{object}	HttpError			"Access is denied"
+//	@Security		ApiKeyAuth
+//	@Router			/devices [get]
+func (api *Api) getAllDevices(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	if !subject.canAny(PermRead) {
+		api.denyAccess(c)
+		return
+	}
+
+	dis, err := api.deviceSvc.GetAllDevicesInfo()
+	if err != nil {
+		panic(err)
+	}
+
+	devices := []ApiDeviceResponse{}
+	for _, di := range dis {
+		if subject.can(PermRead, di.RepoName) {
+			devices = append(devices, ApiDeviceResponse{
+				di.Name,
+				di.RepoName,
+				di.FirmwareUuid,
+				di.CommitId,
+				di.Uptime,
+				di.ResetReason,
+				di.LastCheckinAt.Unix(),
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, devices)
+}
+
+// reportUpdateEvent godoc
+//
+//	@Summary	Report update progress
+//	@Schemes
+//	@Accept			json
+//	@Description	Report update lifecycle event of the board for firmware with given uuid,
+//	@Description	error_code is only stored for failed updates. Requires board:{repo} scope
+//	@Param			uuid	path	string					true	"firmware's UUID"
+//	@Param			event	body	ApiUpdateEventRequest	true	"update event"
+//	@Success		204
+//	@Failure		400	{object}	HttpError	"Invalid event"
+//	@Failure		401	{object}	HttpError	"Invalid auth token"
+//	@Failure		403	{object}	HttpError	"Access is denied"
+//	@Failure		404	{object}	HttpError	"Firmware not found"
+//	@Security		ApiKeyAuth
+//	@Router			/firmwares/{uuid}/events [post]
+func (api *Api) reportUpdateEvent(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	var json ApiUpdateEventRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			err.Error(),
+		})
+		return
+	}
+
+	info, ok := api.firmwareFromPath(c)
+	if !ok {
+		return
+	}
+
+	if !api.authorize(c, subject, PermBoard, info.RepoName) {
+		return
+	}
+
+	if err := api.updateSvc.ReportEvent(info, subject.name, json.Status, json.ErrorCode); err != nil {
+		panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// getUpdateStats godoc
+//
+//	@Summary	Get update stats
+//	@Schemes
+//	@Description	Get number of boards by the last update status they reported for firmware with given uuid.
+//	@Description	Requires read:{repo} scope
+//	@Produce		json
+//	@Param			uuid	path		string					true	"firmware's UUID"
+//	@Success		200		{object}	ApiUpdateStatsResponse	"ok"
+//	@Failure		401		{object}	HttpError				"Invalid auth token"
+//	@Failure		403		{object}	HttpError				"Access is denied"
+//	@Failure		404		{object}	HttpError				"Firmware not found"
+//	@Security		ApiKeyAuth
+//	@Router			/firmwares/{uuid}/stats [get]
+func (api *Api) getUpdateStats(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	info, ok := api.firmwareFromPath(c)
+	if !ok {
+		return
+	}
+
+	if !api.authorize(c, subject, PermRead, info.RepoName) {
+		return
+	}
+
+	stats, err := api.updateSvc.GetStats(info)
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(http.StatusOK, ApiUpdateStatsResponse{
+		info.Uuid,
+		stats.Devices,
+		stats.ByStatus[UpdateDownloading],
+		stats.ByStatus[UpdateInstalled],
+		stats.ByStatus[UpdateBooted],
+		stats.ByStatus[UpdateRolledBack],
+		stats.ByStatus[UpdateFailed],
+		stats.ErrorCodes,
+	})
+}
+
+// setBoardSubscription godoc
+//
+//	@Summary	Subscribe board to channel
+//	@Schemes
+//	@Accept			json
+//	@Description	Set release channel the board gets firmwares of the repo from. Requires upload:{repo} scope
+//	@Param			board			path	string					true	"board name"
+//	@Param			subscription	body	ApiSubscriptionRequest	true	"subscription"
+//	@Success		204
+//	@Failure		400	{object}	HttpError	"Invalid subscription"
+//	@Failure		401	{object}	HttpError	"Invalid auth token"
+//	@Failure		403	{object}	HttpError	"Access is denied"
+//	@Security		ApiKeyAuth
+//	@Router			/boards/{board}/subscriptions [put]
+func (api *Api) setBoardSubscription(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	var json ApiSubscriptionRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			err.Error(),
+		})
+		return
+	}
+
+	if !api.authorize(c, subject, PermUpload, json.RepoName) {
+		return
+	}
+
+	if err := api.firmwareSvc.SetBoardChannel(c.Param("board"), json.RepoName, json.Channel); err != nil {
+		panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// getBoardSubscriptions godoc
+//
+//	@Summary	Get board subscriptions
+//	@Schemes
+//	@Description	Get channels the board is subscribed to in repos the user has read:{repo} scope for.
+//	@Description	Board gets stable releases of repos not listed here
+//	@Produce		json
+//	@Param			board	path		string	true	"board name"
+//	@Success		200		{array}		ApiSubscriptionResponse	"ok"
+//	@Failure		401		{object}	HttpError				"Invalid auth token"
+//	@Failure		403		{object}	HttpError				"Access is denied"
+//	@Security		ApiKeyAuth
+//	@Router			/boards/{board}/subscriptions [get]
+func (api *Api) getBoardSubscriptions(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	if !subject.canAny(PermRead) {
+		api.denyAccess(c)
+		return
+	}
+
+	subs, err := api.firmwareSvc.GetBoardSubscriptions(c.Param("board"))
+	if err != nil {
+		panic(err)
+	}
+
+	resp := []ApiSubscriptionResponse{}
+	for _, sub := range subs {
+		if subject.can(PermRead, sub.RepoName) {
+			resp = append(resp, ApiSubscriptionResponse{sub.RepoName, sub.Channel})
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func newRolloutResponse(info *FirmwareInfo, r *Rollout) ApiRolloutResponse {
+	var pausedAt int64
+	if r.PausedAt.Valid {
+		pausedAt = r.PausedAt.Time.Unix()
+	}
+
+	return ApiRolloutResponse{
+		info.Uuid,
+		r.Percentage,
+		r.UpdatedAt.Unix(),
+		r.UpdatedBy,
+		r.Paused,
+		r.PauseReason,
+		pausedAt,
+	}
+}
+
+// setRollout godoc
+//
+//	@Summary	Update rollout
+//	@Schemes
+//	@Accept			json
+//	@Description	Set percentage of boards the firmware is delivered to, other boards get the previous firmware.
+//	@Description	Boards are chosen by stable hash of their names, so raising the percentage only adds boards.
+//	@Description	Rollout can be paused (no boards get the firmware) or resumed, it is also paused automatically
+//	@Description	when too many boards report failed updates. Requires upload:{repo} scope
+//	@Produce		json
+//	@Param			uuid	path		string				true	"firmware's UUID"
+//	@Param			rollout	body		ApiRolloutRequest	true	"rollout"
+//	@Success		200		{object}	ApiRolloutResponse	"ok"
+//	@Failure		400		{object}	HttpError			"Invalid percentage"
+//	@Failure		401		{object}	HttpError			"Invalid auth token"
+//	@Failure		403		{object}	HttpError			"Access is denied"
+//	@Failure		404		{object}	HttpError			"Firmware not found"
+//	@Security		ApiKeyAuth
+//	@Router			/firmwares/{uuid}/rollout [put]
+func (api *Api) setRollout(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	var json ApiRolloutRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			err.Error(),
+		})
+		return
+	}
+
+	if json.Percentage == nil && json.Paused == nil {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			"percentage or paused is required",
+		})
+		return
+	}
+
+	info, ok := api.firmwareFromPath(c)
+	if !ok {
+		return
+	}
+
+	if !api.authorize(c, subject, PermUpload, info.RepoName) {
+		return
+	}
+
+	var (
+		r   *Rollout
+		err error
+	)
+	if json.Percentage != nil {
+		if r, err = api.rolloutSvc.SetPercentage(info, *json.Percentage, subject.name); err != nil {
+			panic(err)
+		}
+	}
+	if json.Paused != nil && *json.Paused {
+		r, err = api.rolloutSvc.Pause(info, fmt.Sprintf("paused by %s", subject.name), subject.name)
+	} else if json.Paused != nil {
+		r, err = api.rolloutSvc.Resume(info, subject.name)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(http.StatusOK, newRolloutResponse(info, r))
+}
+
+// getRollout godoc
+//
+//	@Summary	Get rollout
+//	@Schemes
+//	@Description	Get percentage of boards the firmware is delivered to. Requires read:{repo} scope
+//	@Produce		json
+//	@Param			uuid	path		string				true	"firmware's UUID"
+//	@Success		200		{object}	ApiRolloutResponse	"ok"
+//	@Failure		401		{object}	HttpError			"Invalid auth token"
+//	@Failure		403		{object}	HttpError			"Access is denied"
+//	@Failure		404		{object}	HttpError			"Firmware not found"
+//	@Security		ApiKeyAuth
+//	@Router			/firmwares/{uuid}/rollout [get]
+func (api *Api) getRollout(c *gin.Context) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return
+	}
+
+	info, ok := api.firmwareFromPath(c)
+	if !ok {
+		return
+	}
+
+	if !api.authorize(c, subject, PermRead, info.RepoName) {
+		return
+	}
+
+	r, err := api.rolloutSvc.GetRollout(info)
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(http.StatusOK, newRolloutResponse(info, r))
+}
+
+func newUploadResponse(info *FirmwareInfo, us *UploadSession, offset int64) ApiUploadResponse {
+	return ApiUploadResponse{
+		us.Id,
+		info.Uuid,
+		offset,
+		us.Size,
+		us.Md5,
+		us.Sha256,
+		us.CreatedAt.Unix(),
+	}
+}
+
+// Authorizes user for uploading firmware from the path.
+func (api *Api) uploadTarget(c *gin.Context) (*TokenSubject, *FirmwareInfo, bool) {
+	subject, ok := api.auth(c)
+	if !ok {
+		return nil, nil, false
+	}
+
+	info, ok := api.firmwareFromPath(c)
+	if !ok {
+		return nil, nil, false
+	}
+
+	if !api.authorize(c, subject, PermUpload, info.RepoName) {
+		return nil, nil, false
+	}
+
+	return subject, info, true
+}
+
+// Writes 404 if there is no upload session with id from the path.
+func (api *Api) uploadFromPath(c *gin.Context, info *FirmwareInfo) (*UploadSession, int64, bool) {
+	us, offset, err := api.firmwareSvc.GetUpload(info, c.Param("id"))
+	if err != nil {
+		switch err.(type) {
+		case *UploadNotFoundError:
+			c.JSON(http.StatusNotFound, HttpError{
+				http.StatusNotFound,
+				err.Error(),
+			})
+			return nil, 0, false
+		default:
+			panic(err)
+		}
+	}
+
+	return us, offset, true
+}
+
+// createUpload godoc
+//
+//	@Summary	Start resumable upload
+//	@Schemes
+//	@Accept			json
+//	@Description	Start resumable upload of firmware binary file with declared size (and MD5, SHA-256, optional).
+//	@Description	Upload chunks with PUT /bin/{uuid}/uploads/{id}, then POST /bin/{uuid}/uploads/{id}/finalize.
+//	@Description	Upload not finalized within upload.sessionLifetime is removed. Requires upload:{repo} scope
+//	@Produce		json
+//	@Param			uuid	path		string					true	"firmware's UUID"
+//	@Param			upload	body		ApiCreateUploadRequest	true	"file info"
+//	@Success		201		{object}	ApiUploadResponse		"ok"
+//	@Failure		400		{object}	HttpError				"File is already uploaded/invalid file info"
+//	@Failure		401		{object}	HttpError				"Invalid auth token"
+//	@Failure		403		{object}	HttpError				"Access denied"
+//	@Failure		404		{object}	HttpError				"Firmware not found"
+//	@Security		ApiKeyAuth
+//	@Router			/bin/{uuid}/uploads [post]
+func (api *Api) createUpload(c *gin.Context) {
+	subject, info, ok := api.uploadTarget(c)
+	if !ok {
+		return
+	}
+
+	var json ApiCreateUploadRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			err.Error(),
+		})
+		return
+	}
+
+	us, err := api.firmwareSvc.CreateUpload(info, json.Size, ExpectedDigests{json.Md5, json.Sha256}, subject.name)
+	if err != nil {
+		switch err.(type) {
+		case *FirmwareFileAlreadyUploaded:
+			c.JSON(http.StatusBadRequest, HttpError{
+				http.StatusBadRequest,
+				"file is already uploaded",
+			})
+			return
+		default:
+			panic(err)
+		}
+	}
+
+	c.JSON(http.StatusCreated, newUploadResponse(info, us, 0))
+}
+
+// getUpload godoc
+//
+//	@Summary	Get resumable upload progress
+//	@Schemes
+//	@Description	Get number of bytes uploaded (offset to continue from). Requires upload:{repo} scope
+//	@Produce		json
+//	@Param			uuid	path		string				true	"firmware's UUID"
+//	@Param			id		path		string				true	"upload ID"
+//	@Success		200		{object}	ApiUploadResponse	"ok"
+//	@Failure		401		{object}	HttpError			"Invalid auth token"
+//	@Failure		403		{object}	HttpError			"Access denied"
+//	@Failure		404		{object}	HttpError			"Firmware/upload not found"
+//	@Security		ApiKeyAuth
+//	@Router			/bin/{uuid}/uploads/{id} [get]
+func (api *Api) getUpload(c *gin.Context) {
+	_, info, ok := api.uploadTarget(c)
+	if !ok {
+		return
+	}
+
+	us, offset, ok := api.uploadFromPath(c, info)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, newUploadResponse(info, us, offset))
+}
+
+// uploadChunk godoc
+//
+//	@Summary	Upload chunk
+//	@Schemes
+//	@Accept			application/octet-stream
+//	@Description	Append chunk (raw request body) to resumable upload. Offset must be equal to the number
+//	@Description	of bytes uploaded so far. If the request is interrupted, the received part of the chunk is kept,
+//	@Description	get the new offset with GET /bin/{uuid}/uploads/{id}. Requires upload:{repo} scope
+//	@Produce		json
+//	@Param			uuid	path		string				true	"firmware's UUID"
+//	@Param			id		path		string				true	"upload ID"
+//	@Param			offset	query		int					true	"offset of the chunk in file"
+//	@Success		200		{object}	ApiUploadResponse	"ok"
+//	@Failure		400		{object}	HttpError			"Invalid offset"
+//	@Failure		401		{object}	HttpError			"Invalid auth token"
+//	@Failure		403		{object}	HttpError			"Access denied"
+//	@Failure		404		{object}	HttpError			"Firmware/upload not found"
+//	@Failure		409		{object}	HttpError			"Offset doesn't match uploaded size"
+//	@Security		ApiKeyAuth
+//	@Router			/bin/{uuid}/uploads/{id} [put]
+func (api *Api) uploadChunk(c *gin.Context) {
+	_, info, ok := api.uploadTarget(c)
+	if !ok {
+		return
+	}
+
+	us, _, ok := api.uploadFromPath(c, info)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			"invalid offset",
+		})
+		return
+	}
+
+	uploaded, err := api.firmwareSvc.AppendUploadChunk(us, offset, c.Request.Body)
+	if err != nil {
+		switch err.(type) {
+		case *UploadOffsetMismatchError:
+			c.JSON(http.StatusConflict, HttpError{
+				http.StatusConflict,
+				err.Error(),
+			})
+			return
+		case *UploadNotFoundError:
+			c.JSON(http.StatusNotFound, HttpError{
+				http.StatusNotFound,
+				err.Error(),
+			})
+			return
+		default:
+			panic(err)
+		}
+	}
+
+	c.JSON(http.StatusOK, newUploadResponse(info, us, uploaded))
+}
+
+// finalizeUpload godoc
+//
+//	@Summary	Finalize resumable upload
+//	@Schemes
+//	@Description	Verify size (and digests if declared) of the uploaded file and add it to the firmware.
+//	@Description	Upload is removed if a digest or the developer's signature doesn't match. Requires upload:{repo} scope
+//	@Param			uuid					path	string	true	"firmware's UUID"
+//	@Param			id						path	string	true	"upload ID"
+//	@Param			X-Firmware-Signature	header	string	false	"developer's signature of the file SHA-256 (base64)"
+//	@Success		204
+//	@Failure		400	{object}	HttpError	"File is already uploaded/size or digest differs/invalid signature"
+//	@Failure		401	{object}	HttpError	"Invalid auth token"
+//	@Failure		403	{object}	HttpError	"Access denied"
+//	@Failure		404	{object}	HttpError	"Firmware/upload not found"
+//	@Security		ApiKeyAuth
+//	@Router			/bin/{uuid}/uploads/{id}/finalize [post]
+func (api *Api) finalizeUpload(c *gin.Context) {
+	_, info, ok := api.uploadTarget(c)
+	if !ok {
+		return
+	}
+
+	us, _, ok := api.uploadFromPath(c, info)
+	if !ok {
+		return
+	}
+
+	signature, err := developerSignature(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, HttpError{
+			http.StatusBadRequest,
+			err.Error(),
+		})
+		return
+	}
+
+	if err := api.firmwareSvc.FinalizeUpload(info, us, signature); err != nil {
+		switch err.(type) {
+		case *FirmwareFileAlreadyUploaded:
+			c.JSON(http.StatusBadRequest, HttpError{
+				http.StatusBadRequest,
+				"file is already uploaded",
+			})
+			return
+		case *UploadNotFoundError:
+			c.JSON(http.StatusNotFound, HttpError{
+				http.StatusNotFound,
+				err.Error(),
+			})
+			return
+		case *UploadSizeMismatchError, *Md5DiffersError, *Sha256DiffersError, *EmptyFirmwareFileError,
+			*MissingDeveloperSignatureError, *InvalidDeveloperSignatureError:
+			c.JSON(http.StatusBadRequest, HttpError{
+				http.StatusBadRequest,
+				err.Error(),
+			})
+			return
+		default:
+			panic(err)
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// abortUpload godoc
+//
+//	@Summary	Abort resumable upload
+//	@Schemes
+//	@Description	Remove upload session and uploaded data. Requires upload:{repo} scope
+//	@Param			uuid	path	string	true	"firmware's UUID"
+//	@Param			id		path	string	true	"upload ID"
+//	@Success		204
+//	@Failure		401	{object}	HttpError	"Invalid auth token"
+//	@Failure		403	{object}	HttpError	"Access denied"
+//	@Failure		404	{object}	HttpError	"Firmware/upload not found"
+//	@Security		ApiKeyAuth
+//	@Router			/bin/{uuid}/uploads/{id} [delete]
+func (api *Api) abortUpload(c *gin.Context) {
+	_, info, ok := api.uploadTarget(c)
+	if !ok {
+		return
+	}
+
+	us, _, ok := api.uploadFromPath(c, info)
+	if !ok {
+		return
+	}
+
+	if err := api.firmwareSvc.AbortUpload(us); err != nil {
+		panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Returns reader of the uploaded file without buffering it: either request body itself
+// or "file" part of multipart form, form parts after it are ignored.
+func uploadedFile(c *gin.Context) (io.Reader, error) {
+	if c.ContentType() == "application/octet-stream" {
+		return c.Request.Body, nil
+	}
+
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no file in form")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
 func (api *Api) StartServer() error {
 	r := gin.Default()
 	v1 := r.Group("/api/v1")
 	{
 		v1.GET("/firmwares/latest", api.getLatestFirmware)
+		v1.GET("/firmwares/signing-key", api.getFirmwareSigningKey)
 		v1.GET("/firmwares", api.getAllFirmwares)
 		v1.POST("/firmwares", api.addFirmware)
+		v1.POST("/firmwares/:uuid/events", api.reportUpdateEvent)
+		v1.GET("/firmwares/:uuid/stats", api.getUpdateStats)
+		v1.PUT("/firmwares/:uuid/rollout", api.setRollout)
+		v1.GET("/firmwares/:uuid/rollout", api.getRollout)
 		v1.GET("/bin/:uuid", api.getFirmwareBinary)
+		v1.HEAD("/bin/:uuid", api.getFirmwareBinary)
+		v1.GET("/bin/:uuid/deltas/:base", api.getFirmwareDelta)
 		v1.POST("/bin/:uuid", api.addFirmwareBinary)
+		v1.POST("/bin/:uuid/uploads", api.createUpload)
+		v1.GET("/bin/:uuid/uploads/:id", api.getUpload)
+		v1.PUT("/bin/:uuid/uploads/:id", api.uploadChunk)
+		v1.DELETE("/bin/:uuid/uploads/:id", api.abortUpload)
+		v1.POST("/bin/:uuid/uploads/:id/finalize", api.finalizeUpload)
 		v1.GET("/users/me", api.getAuthenticatedUser)
+		v1.POST("/devices/checkin", api.deviceCheckin)
+		v1.GET("/devices", api.getAllDevices)
+		v1.PUT("/boards/:board/subscriptions", api.setBoardSubscription)
+		v1.GET("/boards/:board/subscriptions", api.getBoardSubscriptions)
 	}
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 	return r.RunTLS(api.cfg.port, api.cfg.tlsPem, api.cfg.tlsKey)
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestAcceptedVariant(t *testing.T) {
+	variants := []Variant{
+		{Encoding: EncodingLzma, Size: 100},
+		{Encoding: EncodingGzip, Size: 150},
+		{Encoding: EncodingHeatshrink, Size: 120},
+	}
+
+	tests := []struct {
+		acceptEncoding string
+		want           Encoding // empty for the raw binary
+	}{
+		{"", ""},
+		{"gzip", EncodingGzip},
+		{"*", EncodingGzip},
+		{"lzma, heatshrink", ""},
+		{"lzma, gzip;q=0.5", EncodingGzip},
+		{"gzip;q=0", ""},
+		{"*;q=0", ""},
+		{"gzip;q=0.5, identity", ""},
+		{"identity;q=0.1, gzip;q=0.5", EncodingGzip},
+		{"br, deflate", ""},
+		{"GZIP", EncodingGzip},
+	}
+
+	for _, tt := range tests {
+		got := acceptedVariant(tt.acceptEncoding, variants)
+		if (got == nil && tt.want != "") || (got != nil && got.Encoding != tt.want) {
+			t.Errorf("acceptedVariant(%q) = %v, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+
+	if got := acceptedVariant("*", variants[:1]); got != nil {
+		t.Errorf("acceptedVariant(*) without gzip = %v, want raw binary", got)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	fi := &FirmwareInfo{Uuid: "1b4e28ba-2fa1-11d2-883f-0016d3cca427"}
+
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{firmwareEtag(fi), true},
+		{`"1b4e28ba-2fa1-11d2-883f-0016d3cca427"`, true},
+		{`W/"other", W/"1b4e28ba-2fa1-11d2-883f-0016d3cca427"`, true},
+		{`W/"other"`, false},
+		// Boards sending it would never get an update.
+		{"*", false},
+		{`*, W/"other"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, fi); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Private keys for token signing are kept as PKCS#8 PEM files in this
+// directory under storagePath, their metadata is kept in the signing_keys table.
+const SIGNING_KEYS_DIRNAME = "keys"
+
+type SigningKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+type SigningKeysService struct {
+	cfg *Config
+	db  Store
+
+	// Parsed keys by kid, key files are never changed once created.
+	cache map[string]*SigningKey
+	sync.Mutex
+}
+
+func NewSigningKeysService(cfg *Config, db Store) *SigningKeysService {
+	return &SigningKeysService{
+		cfg:   cfg,
+		db:    db,
+		cache: map[string]*SigningKey{},
+	}
+}
+
+type UnsupportedKeyAlgorithmError struct {
+	alg string
+}
+
+func (e *UnsupportedKeyAlgorithmError) Error() string {
+	return fmt.Sprintf("unsupported key algorithm '%s', use EdDSA or ES256", e.alg)
+}
+
+type SigningKeyNotFoundError struct {
+	kid string
+}
+
+func (e *SigningKeyNotFoundError) Error() string {
+	if e.kid == "" {
+		return "token has no key ID and legacy signing key is not configured"
+	}
+	return fmt.Sprintf("signing key '%s' is unknown or retired", e.kid)
+}
+
+func signingMethodByAlg(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case jwt.SigningMethodEdDSA.Alg():
+		return jwt.SigningMethodEdDSA, nil
+	case jwt.SigningMethodES256.Alg():
+		return jwt.SigningMethodES256, nil
+	default:
+		return nil, &UnsupportedKeyAlgorithmError{alg}
+	}
+}
+
+func generatePrivateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case jwt.SigningMethodEdDSA.Alg():
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case jwt.SigningMethodES256.Alg():
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, &UnsupportedKeyAlgorithmError{alg}
+	}
+}
+
+// Key ID is derived from the public key, so it is stable and does not leak anything.
+func keyId(key crypto.Signer) (string, error) {
+	return publicKeyId(key.Public())
+}
+
+func publicKeyId(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return fmt.Sprintf("%x", sum[:8]), nil
+}
+
+func (svc *SigningKeysService) keyPath(kid string) string {
+	return filepath.Join(svc.cfg.storagePath, SIGNING_KEYS_DIRNAME, fmt.Sprintf("%s.pem", kid))
+}
+
+// Writes private key as PKCS#8 PEM readable only by the owner, fails if the file exists.
+func writePrivateKeyFile(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func readPrivateKeyFile(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in key file %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is not a signing key", path)
+	}
+	return signer, nil
+}
+
+func (svc *SigningKeysService) loadKey(rec *SigningKeyRecord) (*SigningKey, error) {
+	svc.Lock()
+	defer svc.Unlock()
+
+	if key, ok := svc.cache[rec.Kid]; ok {
+		return key, nil
+	}
+
+	method, err := signingMethodByAlg(rec.Alg)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := readPrivateKeyFile(svc.keyPath(rec.Kid))
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{rec.Kid, method, private}
+	svc.cache[rec.Kid] = key
+	return key, nil
+}
+
+// Returns the newest non-retiring key or nil if there are no keys.
+func (svc *SigningKeysService) SigningKey() (*SigningKey, error) {
+	rec, err := svc.db.GetActiveSigningKeyRecord()
+	if err != nil || rec == nil {
+		return nil, err
+	}
+
+	return svc.loadKey(rec)
+}
+
+// Returns key with given kid if it is still accepted for token verification.
+func (svc *SigningKeysService) VerificationKey(kid string) (*SigningKey, error) {
+	rec, err := svc.db.GetSigningKeyRecordByKid(kid)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil || rec.isRetired(time.Now()) {
+		return nil, &SigningKeyNotFoundError{kid}
+	}
+
+	return svc.loadKey(rec)
+}
+
+// Generates a new signing key, the previously active keys stay valid
+// for verification until the grace period ends.
+func (svc *SigningKeysService) Rotate(alg string, grace time.Duration) (*SigningKeyRecord, error) {
+	private, err := generatePrivateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := keyId(private)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePrivateKeyFile(svc.keyPath(kid), private); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	rec, err := svc.db.AddSigningKeyRecord(&SigningKeyRecord{
+		Kid:       kid,
+		Alg:       alg,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, svc.db.RetireSigningKeys(kid, now.Add(grace))
+}
+
+func (svc *SigningKeysService) GetAllKeys() ([]SigningKeyRecord, error) {
+	return svc.db.GetAllSigningKeyRecords()
+}
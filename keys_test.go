@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func kidOf(t *testing.T, token string) any {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Header["kid"]
+}
+
+func TestTokenSigningKeys(t *testing.T) {
+	svc := newTestTokenService(t)
+	legacy := newTestToken(t, svc, "read:*")
+	if kid := kidOf(t, legacy); kid != nil {
+		t.Fatalf("token signed with jwt.signingKey has kid %v", kid)
+	}
+
+	first, err := svc.keys.Rotate("EdDSA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstToken := newTestToken(t, svc, "read:*")
+	if kid := kidOf(t, firstToken); kid != first.Kid {
+		t.Fatalf("token kid = %v, want %s", kid, first.Kid)
+	}
+
+	second, err := svc.keys.Rotate("ES256", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondToken := newTestToken(t, svc, "read:*")
+	if kid := kidOf(t, secondToken); kid != second.Kid {
+		t.Fatalf("token kid = %v, want %s", kid, second.Kid)
+	}
+
+	// Within the grace period tokens of the previous key are accepted.
+	for _, token := range []string{legacy, firstToken, secondToken} {
+		if _, err := svc.ParseToken(token); err != nil {
+			t.Errorf("ParseToken() error = %v", err)
+		}
+	}
+
+	if _, err := svc.db.(*DB).Exec(
+		"UPDATE signing_keys SET retiresAt = ? WHERE kid = ?",
+		time.Now().Add(-time.Second),
+		first.Kid,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ParseToken(firstToken); !errors.As(err, new(*SigningKeyNotFoundError)) {
+		t.Errorf("ParseToken() with retired key error = %v, want SigningKeyNotFoundError", err)
+	}
+	if _, err := svc.ParseToken(secondToken); err != nil {
+		t.Errorf("ParseToken() with active key error = %v", err)
+	}
+}
+
+func TestParseTokenAlgorithmConfusion(t *testing.T) {
+	svc := newTestTokenService(t)
+	rec, err := svc.keys.Rotate("EdDSA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := svc.keys.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := key.private.Public().(ed25519.PublicKey)
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// HS256 with whatever an attacker may take for the secret of the Ed25519 kid.
+	secrets := map[string][]byte{
+		"raw public key": public,
+		"DER public key": der,
+		"jwt.signingKey": []byte(svc.cfg.jwtSigningKey),
+		"empty":          {},
+	}
+	for name, secret := range secrets {
+		claims := jwt.MapClaims{
+			"iss":   svc.cfg.jwtIssuer,
+			"sub":   "sub",
+			"scope": "admin",
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+		recordTestToken(t, svc, claims)
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = rec.Kid
+		signed, err := token.SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub, err := svc.ParseToken(signed); err == nil {
+			t.Errorf("%s: HS256 token with Ed25519 kid accepted: %+v", name, sub)
+		}
+	}
+}
+
+func TestRotateKeyCommand(t *testing.T) {
+	svc := newTestTokenService(t)
+	cli := func(args ...string) string {
+		t.Helper()
+		out, err := (&CliService{
+			tokenSvc: svc,
+			keysSvc:  svc.keys,
+			db:       svc.db,
+			args:     append([]string{"ota_server", "key", "rotate"}, args...),
+		}).ExecuteCliCommands()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	cli("-a", "EdDSA")
+	first, err := svc.keys.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(svc.keys.keyPath(first.kid)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file %v, %v, want mode 0600", info, err)
+	}
+
+	// The board token lives 24h, longer than the grace period.
+	newTestToken(t, svc, "board:repoA")
+	newTestToken(t, svc, "read:repoA")
+	out := cli("-a", "ES256", "-g", "1h")
+	if !strings.Contains(out, "warning: 1 board tokens") {
+		t.Errorf("key rotate output has no warning about the board token:\n%s", out)
+	}
+
+	second, err := svc.keys.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.kid == first.kid || second.method != jwt.SigningMethodES256 || !strings.Contains(out, second.kid) {
+		t.Fatalf("active key %s %s after rotation, output:\n%s", second.kid, second.method.Alg(), out)
+	}
+
+	recs, err := svc.keys.GetAllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		switch rec.Kid {
+		case first.kid:
+			if !rec.RetiresAt.Valid || rec.RetiresAt.Time.Sub(rec.CreatedAt) < time.Hour-time.Minute {
+				t.Errorf("previous key retires at %v, want in 1h", rec.RetiresAt)
+			}
+		case second.kid:
+			if rec.RetiresAt.Valid {
+				t.Errorf("active key retires at %v", rec.RetiresAt.Time)
+			}
+		}
+	}
+
+	if out := cli("-g", "48h"); strings.Contains(out, "warning") {
+		t.Errorf("key rotate warns although tokens outlive the grace period:\n%s", out)
+	}
+}
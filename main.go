@@ -17,21 +17,55 @@ func main() {
 		panic(err)
 	}
 
-	tokenSvc := TokenService{cfg}
+	var db *DB
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		// Shows and applies pending migrations itself.
+		db, err = OpenDB(cfg)
+	} else {
+		db, err = NewDB(cfg)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	keysSvc := NewSigningKeysService(cfg, db)
+	tokenSvc := TokenService{cfg, db, keysSvc}
+	devKeysSvc := DeveloperKeysService{cfg, db}
 
 	if len(os.Args) == 1 {
-		db, err := NewDB(cfg)
+		storage, err := NewStorage(cfg)
+		if err != nil {
+			panic(err)
+		}
+		binSvc := BinariesService{cfg: cfg, db: db, storage: storage}
+		if err := binSvc.MigrateLegacyBinaries(); err != nil {
+			panic(err)
+		}
+		deltaSvc := NewDeltaService(cfg, db, &binSvc)
+		compressionSvc := CompressionService{cfg, &binSvc}
+		signer, err := NewFirmwareSigner(cfg)
 		if err != nil {
 			panic(err)
 		}
-		binSvc := BinariesService{cfg}
 		firmwareSvc := FirmwareService{
+			cfg,
 			db,
 			&binSvc,
+			signer,
+			&devKeysSvc,
+			deltaSvc,
+			&compressionSvc,
 		}
+		go firmwareSvc.RemoveExpiredUploadsPeriodically()
+		deviceSvc := DeviceService{db}
+		rolloutSvc := RolloutService{cfg, db}
+		updateSvc := UpdateService{db, &rolloutSvc}
 		api := Api{
 			&firmwareSvc,
 			&tokenSvc,
+			&deviceSvc,
+			&updateSvc,
+			&rolloutSvc,
 			cfg,
 		}
 		if err := api.StartServer(); err != nil {
@@ -39,12 +73,28 @@ func main() {
 		}
 	} else if len(os.Args) == 2 && (os.Args[1] == "--help" || os.Args[1] == "-h") {
 		fmt.Printf("%s - launch HTTP server\n", os.Args[0])
-		fmt.Printf("%s token <subject-name> [-b] - generate JWT for subject\n", os.Args[0])
-		fmt.Printf("\t-b - if subject is board\n")
+		fmt.Printf("%s token <subject-name> [-b] [-s <scopes>] [-r <repos>] - generate JWT for subject\n", os.Args[0])
+		fmt.Printf("\t-b - if subject is board (default scope is board:<repo>)\n")
+		fmt.Printf("\t-s - comma-separated permissions (admin, read, upload, board) or full scopes like upload:repoA,\n")
+		fmt.Printf("\t     default is read,upload for developers\n")
+		fmt.Printf("\t-r - comma-separated repos the permissions are granted for, default is *\n")
+		fmt.Printf("%s tokens - list issued tokens\n", os.Args[0])
+		fmt.Printf("%s revoke <jti> - revoke token with given ID\n", os.Args[0])
+		fmt.Printf("%s keys - list token signing keys\n", os.Args[0])
+		fmt.Printf("%s key rotate [-a <alg>] [-g <grace>] - generate new token signing key\n", os.Args[0])
+		fmt.Printf("\t-a - EdDSA or ES256, default is jwt.keyAlgorithm from config\n")
+		fmt.Printf("\t-g - how long tokens signed by previous keys stay valid, default is jwt.keyGracePeriod\n")
+		fmt.Printf("%s devkey add <subject-name> <public-key.pem> - register developer's firmware signing key\n", os.Args[0])
+		fmt.Printf("%s devkeys - list developer keys\n", os.Args[0])
+		fmt.Printf("%s devkey revoke <kid> - revoke developer key\n", os.Args[0])
+		fmt.Printf("%s migrate [status] - apply pending database migrations or list them\n", os.Args[0])
 		os.Exit(0)
 	} else {
 		cliSvc := CliService{
 			&tokenSvc,
+			keysSvc,
+			&devKeysSvc,
+			db,
 			os.Args,
 		}
 		result, err := cliSvc.ExecuteCliCommands()
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema changes are files named <version>_<name>.sql, applied in order of versions,
+// each in its own transaction, and recorded in schema_version. SQL is written for
+// SQLite and translated for PostgreSQL, see DB.ddl. Applied files must not be changed,
+// add a new one instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	sql     string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt sql.NullTime // null for pending migrations
+}
+
+type InvalidMigrationNameError struct {
+	name string
+}
+
+func (e *InvalidMigrationNameError) Error() string {
+	return fmt.Sprintf("migration file name '%s' doesn't match <version>_<name>.sql", e.name)
+}
+
+type SchemaVersionError struct {
+	version int
+	latest  int
+}
+
+func (e *SchemaVersionError) Error() string {
+	if e.version > e.latest {
+		return fmt.Sprintf("database schema version %d is newer than %d known to this server", e.version, e.latest)
+	}
+	return fmt.Sprintf("database schema version %d is older than %d, run migrate command", e.version, e.latest)
+}
+
+// Returns embedded migrations ordered by version.
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []Migration
+	for _, e := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		v, err := strconv.Atoi(version)
+		if !ok || err != nil || v <= 0 {
+			return nil, &InvalidMigrationNameError{e.Name()}
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Migration{v, name, string(data)})
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	for i := 1; i < len(ms); i++ {
+		if ms[i].Version == ms[i-1].Version {
+			return nil, &InvalidMigrationNameError{fmt.Sprintf("%04d_%s.sql", ms[i].Version, ms[i].Name)}
+		}
+	}
+	return ms, nil
+}
+
+func latestVersion(ms []Migration) int {
+	if len(ms) == 0 {
+		return 0
+	}
+	return ms[len(ms)-1].Version
+}
+
+func (db *DB) createSchemaVersionTable() error {
+	_, err := db.Exec(db.ddl(`
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version     INTEGER PRIMARY KEY,
+        name        TEXT NOT NULL,
+        appliedAt   DATETIME NOT NULL
+    );`))
+	return err
+}
+
+// Returns 0 if no migrations are applied.
+func (db *DB) schemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// Returns SchemaVersionError if there are pending migrations or the database was
+// migrated by a newer server.
+func (db *DB) CheckSchemaVersion() error {
+	ms, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := db.createSchemaVersionTable(); err != nil {
+		return err
+	}
+
+	version, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version != latestVersion(ms) {
+		return &SchemaVersionError{version, latestVersion(ms)}
+	}
+	return nil
+}
+
+func (db *DB) GetMigrationStatus() ([]MigrationStatus, error) {
+	ms, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.createSchemaVersionTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT version, appliedAt FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	statuses := make([]MigrationStatus, len(ms))
+	for i, m := range ms {
+		statuses[i].Migration = m
+		if appliedAt, ok := applied[m.Version]; ok {
+			statuses[i].AppliedAt = sql.NullTime{Time: appliedAt, Valid: true}
+		}
+	}
+	return statuses, nil
+}
+
+// Applies pending migrations, returns the applied ones (also those applied before
+// a failed one).
+func (db *DB) Migrate() ([]Migration, error) {
+	ms, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.createSchemaVersionTable(); err != nil {
+		return nil, err
+	}
+
+	version, err := db.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > latestVersion(ms) {
+		return nil, &SchemaVersionError{version, latestVersion(ms)}
+	}
+
+	var applied []Migration
+	for _, m := range ms {
+		if m.Version <= version {
+			continue
+		}
+		if err := db.applyMigration(m); err != nil {
+			return applied, fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// Migration applied meanwhile by another server is skipped.
+func (db *DB) applyMigration(m Migration) error {
+	return db.inTx(func(tx *Tx) error {
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM schema_version WHERE version = ?", m.Version).Scan(&count)
+		if err != nil || count != 0 {
+			return err
+		}
+
+		if m.Version == 1 && db.dialect == DialectSqlite {
+			if err := addLegacyColumns(tx); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(db.ddl(m.sql)); err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO schema_version (version, name, appliedAt) VALUES (?, ?, ?)",
+			m.Version,
+			m.Name,
+			time.Now().UTC(),
+		)
+		return err
+	})
+}
+
+// Tables of SQLite databases created before migrations were introduced may lack
+// columns added after the table was first released. Tables missing altogether
+// are created by the initial migration.
+func addLegacyColumns(tx *Tx) error {
+	columns := []struct{ table, column, definition string }{
+		{"firmwares", "channel", "TEXT NOT NULL DEFAULT 'stable'"},
+		{"rollouts", "paused", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"rollouts", "pauseReason", "TEXT NOT NULL DEFAULT ''"},
+		{"rollouts", "pausedAt", "DATETIME"},
+		{"rollouts", "resumedAt", "DATETIME"},
+		{"firmwares", "version", "TEXT NOT NULL DEFAULT ''"},
+		{"firmwares", "versionKey", "TEXT COLLATE BINARY NOT NULL DEFAULT ''"},
+		{"firmwares", "sha256", "TEXT NOT NULL DEFAULT ''"},
+		{"uploads", "sha256", "TEXT NOT NULL DEFAULT ''"},
+		{"firmwares", "signature", "TEXT NOT NULL DEFAULT ''"},
+		{"firmwares", "signatureKid", "TEXT NOT NULL DEFAULT ''"},
+		{"firmwares", "devSignature", "TEXT NOT NULL DEFAULT ''"},
+		{"firmwares", "devKid", "TEXT NOT NULL DEFAULT ''"},
+	}
+
+	for _, c := range columns {
+		var tableColumns, count int
+		err := tx.QueryRow(
+			"SELECT COUNT(*), COUNT(CASE WHEN name = ? THEN 1 END) FROM pragma_table_info(?)",
+			c.column,
+			c.table,
+		).Scan(&tableColumns, &count)
+		if err != nil {
+			return err
+		}
+		if tableColumns == 0 || count != 0 {
+			continue
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) DataMigrationApplied(name string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM data_migrations WHERE name = ?", name).Scan(&count)
+	return count != 0, err
+}
+
+func (db *DB) SetDataMigrationApplied(name string) error {
+	_, err := db.Exec(
+		"INSERT INTO data_migrations (name, appliedAt) VALUES (?, ?) ON CONFLICT (name) DO NOTHING",
+		name,
+		time.Now().UTC(),
+	)
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Database created by the server before migrations were introduced is upgraded
+// in place, keeping its firmwares.
+func TestMigrateBaseline(t *testing.T) {
+	cfg := &Config{storagePath: t.TempDir(), databaseAutoMigrate: true}
+
+	fixture, err := os.ReadFile("testdata/baseline.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := sql.Open(string(DialectSqlite), filepath.Join(cfg.storagePath, SQLITE_DB_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := baseline.Exec(string(fixture)); err != nil {
+		t.Fatal(err)
+	}
+	baseline.Close()
+
+	db, err := NewDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.CheckSchemaVersion(); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := db.GetMigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.AppliedAt.Valid {
+			t.Errorf("migration %d isn't applied", s.Version)
+		}
+	}
+
+	fis, err := db.GetAllFirmwaresInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 3 {
+		t.Fatalf("%d firmwares after migration, want 3", len(fis))
+	}
+
+	want := []struct {
+		uuid, repo, commit, createdBy, md5, description string
+		createdAt                                       time.Time
+		size                                            int
+		boards                                          []string
+	}{
+		{"0b6f0d6c-8d7e-4b7a-9a51-4a3b1c1e0001", "repoA", "a1b2c3d", "alice", "9e107d9d372bb6826bd81d3542a419d6",
+			"first release", time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC), 1024, []string{"board-1", "board-2"}},
+		{"0b6f0d6c-8d7e-4b7a-9a51-4a3b1c1e0002", "repoA", "e4f5a6b", "bob", "e4d909c290d0fb1ca068ffaddf22cbd0",
+			"fixes", time.Date(2023, 3, 2, 8, 30, 0, 0, time.UTC), 2048, []string{"board-1"}},
+		{"0b6f0d6c-8d7e-4b7a-9a51-4a3b1c1e0003", "repoB", "c7d8e9f", "alice", "d41d8cd98f00b204e9800998ecf8427e",
+			"", time.Date(2023, 3, 3, 9, 15, 0, 0, time.UTC), 0, []string{"board-3"}},
+	}
+	for _, w := range want {
+		fi, err := db.GetFirmareInfoByUuid(w.uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi == nil {
+			t.Errorf("firmware %s is lost", w.uuid)
+			continue
+		}
+		if fi.RepoName != w.repo || fi.CommitId != w.commit || fi.CreatedBy != w.createdBy || fi.Md5 != w.md5 ||
+			fi.Description != w.description || !fi.CreatedAt.Equal(w.createdAt) || fi.Size != w.size ||
+			fi.Channel != ChannelStable {
+			t.Errorf("firmware %s after migration = %+v", w.uuid, fi)
+		}
+		boards := slices.Clone(fi.Boards)
+		slices.Sort(boards)
+		if !slices.Equal(boards, w.boards) {
+			t.Errorf("boards of %s = %v, want %v", w.uuid, boards, w.boards)
+		}
+	}
+
+	var boards int
+	if err := db.QueryRow("SELECT COUNT(*) FROM boards").Scan(&boards); err != nil {
+		t.Fatal(err)
+	}
+	if boards != 4 {
+		t.Errorf("%d boards rows, duplicate and orphaned ones must be dropped", boards)
+	}
+
+	// Ids continue after the existing firmwares.
+	fi := addTestFirmware(t, db, "repoA", "1.0.0", []string{"board-1"})
+	if fi.Id != 4 {
+		t.Errorf("firmware added after migration has id %d", fi.Id)
+	}
+
+	if applied, err := db.Migrate(); err != nil || len(applied) != 0 {
+		t.Errorf("Migrate() of migrated database = %v, %v", applied, err)
+	}
+}
@@ -0,0 +1,116 @@
+-- Schema as it was when migrations were introduced. Tables of databases created
+-- before that already exist, their missing columns are added beforehand.
+CREATE TABLE IF NOT EXISTS firmwares (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid        TEXT UNIQUE NOT NULL,
+    repoName    TEXT NOT NULL,
+    commitId    TEXT NOT NULL,
+    createdAt   DATETIME NOT NULL,
+    createdBy   TEXT NOT NULL,
+    md5         TEXT NOT NULL,
+    description TEXT NOT NULL,
+    size        INTEGER NOT NULL,
+    channel     TEXT NOT NULL DEFAULT 'stable',
+    version     TEXT NOT NULL DEFAULT '',
+    versionKey  TEXT COLLATE BINARY NOT NULL DEFAULT '',
+    sha256      TEXT NOT NULL DEFAULT '',
+    signature   TEXT NOT NULL DEFAULT '',
+    signatureKid TEXT NOT NULL DEFAULT '',
+    devSignature TEXT NOT NULL DEFAULT '',
+    devKid      TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS boards (
+    boardName   TEXT NOT NULL,
+    firmwareId  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tokens (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    jti         TEXT UNIQUE NOT NULL,
+    subject     TEXT NOT NULL,
+    scope       TEXT NOT NULL,
+    issuedAt    DATETIME NOT NULL,
+    expiresAt   DATETIME NOT NULL,
+    revokedAt   DATETIME
+);
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    kid         TEXT UNIQUE NOT NULL,
+    alg         TEXT NOT NULL,
+    createdAt   DATETIME NOT NULL,
+    retiresAt   DATETIME
+);
+CREATE TABLE IF NOT EXISTS developer_keys (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    kid         TEXT UNIQUE NOT NULL,
+    subject     TEXT NOT NULL,
+    alg         TEXT NOT NULL,
+    publicKey   TEXT NOT NULL,
+    createdAt   DATETIME NOT NULL,
+    revokedAt   DATETIME
+);
+CREATE TABLE IF NOT EXISTS blobs (
+    sha256      TEXT PRIMARY KEY,
+    size        INTEGER NOT NULL,
+    refCount    INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS variants (
+    firmwareId  INTEGER NOT NULL,
+    encoding    TEXT NOT NULL,
+    size        INTEGER NOT NULL,
+    sha256      TEXT NOT NULL,
+    PRIMARY KEY (firmwareId, encoding)
+);
+CREATE TABLE IF NOT EXISTS deltas (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    firmwareId      INTEGER NOT NULL,
+    baseFirmwareId  INTEGER NOT NULL,
+    size            INTEGER NOT NULL,
+    sha256          TEXT NOT NULL,
+    createdAt       DATETIME NOT NULL,
+    UNIQUE (firmwareId, baseFirmwareId)
+);
+CREATE TABLE IF NOT EXISTS devices (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    name            TEXT UNIQUE NOT NULL,
+    repoName        TEXT NOT NULL,
+    firmwareUuid    TEXT NOT NULL,
+    commitId        TEXT NOT NULL,
+    uptime          INTEGER NOT NULL,
+    resetReason     TEXT NOT NULL,
+    lastCheckinAt   DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS update_events (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    firmwareId  INTEGER NOT NULL,
+    deviceName  TEXT NOT NULL,
+    status      TEXT NOT NULL,
+    errorCode   TEXT NOT NULL,
+    createdAt   DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS subscriptions (
+    boardName   TEXT NOT NULL,
+    repoName    TEXT NOT NULL,
+    channel     TEXT NOT NULL,
+    PRIMARY KEY (boardName, repoName)
+);
+CREATE TABLE IF NOT EXISTS rollouts (
+    firmwareId  INTEGER PRIMARY KEY,
+    percentage  INTEGER NOT NULL,
+    updatedAt   DATETIME NOT NULL,
+    updatedBy   TEXT NOT NULL,
+    paused      BOOLEAN NOT NULL DEFAULT 0,
+    pauseReason TEXT NOT NULL DEFAULT '',
+    pausedAt    DATETIME,
+    resumedAt   DATETIME
+);
+CREATE TABLE IF NOT EXISTS uploads (
+    id          TEXT PRIMARY KEY,
+    firmwareId  INTEGER NOT NULL,
+    size        INTEGER NOT NULL,
+    md5         TEXT NOT NULL,
+    createdBy   TEXT NOT NULL,
+    createdAt   DATETIME NOT NULL,
+    sha256      TEXT NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX IF NOT EXISTS firmwaresRepoVersion
+ON firmwares (repoName, versionKey) WHERE versionKey != '';
@@ -0,0 +1,13 @@
+-- SQLite can't add a constraint to an existing table, so boards is rebuilt.
+-- Duplicate rows and rows of missing firmwares are dropped on the way.
+CREATE TABLE boards_new (
+    boardName   TEXT NOT NULL,
+    firmwareId  INTEGER NOT NULL REFERENCES firmwares (id) ON DELETE CASCADE,
+    PRIMARY KEY (firmwareId, boardName)
+);
+INSERT INTO boards_new (boardName, firmwareId)
+SELECT DISTINCT boardName, firmwareId FROM boards
+WHERE firmwareId IN (SELECT id FROM firmwares);
+DROP TABLE boards;
+ALTER TABLE boards_new RENAME TO boards;
+CREATE INDEX boardsBoardName ON boards (boardName);
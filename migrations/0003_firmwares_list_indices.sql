@@ -0,0 +1,3 @@
+-- Pages of GET /firmwares are read in these orders, filtered by the author.
+CREATE INDEX firmwaresRepoVersionKey ON firmwares (repoName, versionKey, id);
+CREATE INDEX firmwaresCreatedBy ON firmwares (createdBy);
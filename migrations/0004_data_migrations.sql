@@ -0,0 +1,6 @@
+-- Changes of data kept outside the database (e.g. layout of binaries in storage),
+-- each applied by the server once.
+CREATE TABLE data_migrations (
+    name        TEXT PRIMARY KEY,
+    appliedAt   DATETIME NOT NULL
+);
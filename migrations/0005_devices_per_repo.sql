@@ -0,0 +1,17 @@
+-- A board may check in for several repos, its state is kept for each of them.
+CREATE TABLE devices_new (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    name            TEXT NOT NULL,
+    repoName        TEXT NOT NULL,
+    firmwareUuid    TEXT NOT NULL,
+    commitId        TEXT NOT NULL,
+    uptime          INTEGER NOT NULL,
+    resetReason     TEXT NOT NULL,
+    lastCheckinAt   DATETIME NOT NULL,
+    UNIQUE (name, repoName)
+);
+INSERT INTO devices_new (name, repoName, firmwareUuid, commitId, uptime, resetReason, lastCheckinAt)
+SELECT name, repoName, firmwareUuid, commitId, uptime, resetReason, lastCheckinAt FROM devices
+ORDER BY id;
+DROP TABLE devices;
+ALTER TABLE devices_new RENAME TO devices;
@@ -0,0 +1,8 @@
+-- Health gate tells update events reported after resuming by id, SQLite compares
+-- timestamps to the millisecond only. Already resumed rollouts count events from now on.
+ALTER TABLE rollouts ADD COLUMN resumedAfterEvent INTEGER NOT NULL DEFAULT 0;
+UPDATE rollouts SET resumedAfterEvent = COALESCE(
+    (SELECT MAX(id) FROM update_events WHERE update_events.firmwareId = rollouts.firmwareId),
+    0
+)
+WHERE resumedAt IS NOT NULL;
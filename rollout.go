@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+type RolloutService struct {
+	cfg *Config
+	db  Store
+}
+
+// Stable bucket in [0, 100) of the board for the firmware. Board is in rollout
+// if its bucket is less than rollout percentage, so raising the percentage
+// only adds boards. The firmware uuid is mixed in, so different releases
+// are not always tried on the same boards first.
+func rolloutBucket(uuid string, board string) int {
+	sum := sha256.Sum256([]byte(uuid + "/" + board))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
+func inRollout(rc *RolloutCandidate, board string) bool {
+	return rolloutBucket(rc.Uuid, board) < rc.Percentage
+}
+
+func (svc *RolloutService) update(fi *FirmwareInfo, by string, modify func(r *Rollout)) (*Rollout, error) {
+	r, err := svc.GetRollout(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	modify(r)
+	r.UpdatedAt = time.Now()
+	r.UpdatedBy = by
+
+	if err := svc.db.SetRollout(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (svc *RolloutService) SetPercentage(fi *FirmwareInfo, percentage int, by string) (*Rollout, error) {
+	return svc.update(fi, by, func(r *Rollout) {
+		r.Percentage = percentage
+	})
+}
+
+func (svc *RolloutService) Pause(fi *FirmwareInfo, reason string, by string) (*Rollout, error) {
+	return svc.update(fi, by, func(r *Rollout) {
+		if r.Paused {
+			return
+		}
+		r.Paused = true
+		r.PauseReason = reason
+		r.PausedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	})
+}
+
+// Update outcomes reported before resuming are not considered by health gate anymore.
+func (svc *RolloutService) Resume(fi *FirmwareInfo, by string) (*Rollout, error) {
+	lastEvent, err := svc.db.GetLastUpdateEventId(fi.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return svc.update(fi, by, func(r *Rollout) {
+		if !r.Paused {
+			return
+		}
+		r.Paused = false
+		r.PauseReason = ""
+		r.PausedAt = sql.NullTime{}
+		r.ResumedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		r.ResumedAfterEvent = lastEvent
+	})
+}
+
+// Pauses rollout if too many boards failed to update or rolled back.
+func (svc *RolloutService) CheckHealth(fi *FirmwareInfo) error {
+	r, err := svc.GetRollout(fi)
+	if err != nil || r.Paused {
+		return err
+	}
+
+	stats, err := svc.db.GetUpdateStats(fi.Id, r.ResumedAfterEvent)
+	if err != nil {
+		return err
+	}
+
+	failed := stats.ByStatus[UpdateFailed] + stats.ByStatus[UpdateRolledBack]
+	finished := failed + stats.ByStatus[UpdateBooted]
+	if finished == 0 || finished < svc.cfg.rolloutMinReports {
+		return nil
+	}
+
+	ratio := float64(failed) / float64(finished)
+	if ratio <= svc.cfg.rolloutMaxFailureRatio {
+		return nil
+	}
+
+	reason := fmt.Sprintf(
+		"failure ratio %.2f (%d of %d boards failed or rolled back) exceeds %.2f",
+		ratio,
+		failed,
+		finished,
+		svc.cfg.rolloutMaxFailureRatio,
+	)
+	_, err = svc.Pause(fi, reason, "health gate")
+	return err
+}
+
+// Firmwares without rollout record are rolled out to all boards since upload.
+func (svc *RolloutService) GetRollout(fi *FirmwareInfo) (*Rollout, error) {
+	r, err := svc.db.GetRollout(fi.Id)
+	if err != nil || r != nil {
+		return r, err
+	}
+
+	return &Rollout{
+		FirmwareId: fi.Id,
+		Percentage: 100,
+		UpdatedAt:  fi.CreatedAt,
+		UpdatedBy:  fi.CreatedBy,
+	}, nil
+}
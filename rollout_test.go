@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"testing"
+	"time"
+)
+
+func testBoards(n int) []string {
+	boards := make([]string, n)
+	for i := range boards {
+		boards[i] = fmt.Sprintf("board-%d", i)
+	}
+	return boards
+}
+
+func newTestFirmwareInfo(t *testing.T, repo string, version string, boards []string) *FirmwareInfo {
+	t.Helper()
+	return &FirmwareInfo{
+		Uuid:       repo + "-" + version,
+		RepoName:   repo,
+		Boards:     boards,
+		CreatedAt:  time.Now(),
+		CreatedBy:  "dev",
+		Channel:    ChannelStable,
+		Version:    version,
+		VersionKey: versionKey(t, version),
+	}
+}
+
+// Adds firmware with a binary (not stored) for the boards.
+func addTestFirmware(t *testing.T, db *DB, repo string, version string, boards []string) *FirmwareInfo {
+	t.Helper()
+	info := newTestFirmwareInfo(t, repo, version, boards)
+	info.Size = 1
+	fi, err := db.AddFirmwareInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+func TestRolloutBucket(t *testing.T) {
+	counts := make([]int, 10)
+	for _, board := range testBoards(1000) {
+		bucket := rolloutBucket("firmware", board)
+		if bucket < 0 || bucket >= 100 {
+			t.Fatalf("rolloutBucket(%s) = %d", board, bucket)
+		}
+		if again := rolloutBucket("firmware", board); again != bucket {
+			t.Fatalf("rolloutBucket(%s) = %d, then %d", board, bucket, again)
+		}
+		counts[bucket/10]++
+	}
+	// 100 boards expected in each tenth.
+	for i, count := range counts {
+		if count < 50 || count > 150 {
+			t.Errorf("%d boards in buckets %d-%d", count, i*10, i*10+9)
+		}
+	}
+
+	same := 0
+	for _, board := range testBoards(1000) {
+		if rolloutBucket("firmware", board) == rolloutBucket("other firmware", board) {
+			same++
+		}
+	}
+	if same > 50 {
+		t.Errorf("%d of 1000 boards in the same bucket for another firmware", same)
+	}
+}
+
+func TestInRolloutEdges(t *testing.T) {
+	for _, board := range testBoards(1000) {
+		if inRollout(&RolloutCandidate{"firmware", 0}, board) {
+			t.Fatalf("%s is in 0%% rollout", board)
+		}
+		if !inRollout(&RolloutCandidate{"firmware", 100}, board) {
+			t.Fatalf("%s isn't in 100%% rollout", board)
+		}
+		// Raising the percentage only adds boards.
+		if inRollout(&RolloutCandidate{"firmware", 30}, board) && !inRollout(&RolloutCandidate{"firmware", 31}, board) {
+			t.Fatalf("%s left rollout when it was raised", board)
+		}
+	}
+}
+
+func TestGetLatestFirmwareRollout(t *testing.T) {
+	db := newTestDB(t)
+	serv := &FirmwareService{db: db}
+	rollouts := &RolloutService{&Config{}, db}
+	boards := testBoards(200)
+
+	v1 := addTestFirmware(t, db, "repo", "1.0.0", boards)
+	v2 := addTestFirmware(t, db, "repo", "1.1.0", boards)
+
+	// Returns how many boards get v2, failing if others don't get v1.
+	check := func(name string, percentage int) int {
+		t.Helper()
+		inV2 := 0
+		for _, board := range boards {
+			fi, err := serv.GetLatestFirmware("repo", board, ChannelStable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := v1
+			if inRollout(&RolloutCandidate{v2.Uuid, percentage}, board) {
+				want = v2
+				inV2++
+			}
+			if fi == nil || fi.Uuid != want.Uuid {
+				t.Fatalf("%s: %s got %+v, want %s", name, board, fi, want.Version)
+			}
+		}
+		return inV2
+	}
+
+	if n := check("no rollout", 100); n != len(boards) {
+		t.Fatalf("%d of %d boards got firmware without rollout", n, len(boards))
+	}
+
+	if _, err := rollouts.SetPercentage(v2, 30, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if n := check("30%", 30); n < 30 || n > 90 {
+		t.Errorf("%d of %d boards in 30%% rollout", n, len(boards))
+	}
+
+	if _, err := rollouts.Pause(v2, "test", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	check("paused", 0)
+
+	if _, err := rollouts.Resume(v2, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	check("resumed", 30)
+
+	if _, err := rollouts.SetPercentage(v2, 0, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	check("0%", 0)
+
+	if _, err := rollouts.SetPercentage(v2, 100, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	check("100%", 100)
+}
+
+// Firmware created with a partial rollout is never delivered to boards outside it.
+func TestAddFirmwareInfoRollout(t *testing.T) {
+	db := newTestDB(t)
+	serv := &FirmwareService{db: db}
+	boards := testBoards(100)
+
+	v1 := addTestFirmware(t, db, "repo", "1.0.0", boards)
+	if r, err := db.GetRollout(v1.Id); err != nil || r != nil {
+		t.Fatalf("GetRollout() of firmware without rollout = %+v, %v", r, err)
+	}
+
+	percentage := 30
+	info := newTestFirmwareInfo(t, "repo", "1.1.0", boards)
+	info.Size = 1
+	info.RolloutPercentage = &percentage
+	v2, err := db.AddFirmwareInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := db.GetRollout(v2.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.Percentage != percentage || r.UpdatedBy != info.CreatedBy || r.Paused {
+		t.Fatalf("GetRollout() of firmware created with 30%% rollout = %+v", r)
+	}
+	for _, board := range boards {
+		fi, err := serv.GetLatestFirmware("repo", board, ChannelStable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := v1
+		if inRollout(&RolloutCandidate{v2.Uuid, percentage}, board) {
+			want = v2
+		}
+		if fi == nil || fi.Uuid != want.Uuid {
+			t.Errorf("%s got %+v, want %s", board, fi, want.Version)
+		}
+	}
+
+	// Rollout of a firmware that isn't added isn't left behind.
+	info.Uuid = "duplicate"
+	if _, err := db.AddFirmwareInfo(info); err == nil {
+		t.Fatal("firmware with duplicate version was added")
+	}
+	var rollouts int
+	if err := db.QueryRow("SELECT COUNT(*) FROM rollouts").Scan(&rollouts); err != nil {
+		t.Fatal(err)
+	}
+	if rollouts != 1 {
+		t.Errorf("%d rollouts after failed AddFirmwareInfo(), want 1", rollouts)
+	}
+}
+
+// Boards outside a partial rollout of the only firmware get nothing.
+func TestGetLatestFirmwareNoFallback(t *testing.T) {
+	db := newTestDB(t)
+	serv := &FirmwareService{db: db}
+	boards := testBoards(100)
+
+	fi := addTestFirmware(t, db, "repo", "1.0.0", boards)
+	if _, err := (&RolloutService{&Config{}, db}).SetPercentage(fi, 50, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, board := range boards {
+		got, err := serv.GetLatestFirmware("repo", board, ChannelStable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := inRollout(&RolloutCandidate{fi.Uuid, 50}, board); (got != nil) != want {
+			t.Errorf("%s got %+v, in rollout %v", board, got, want)
+		}
+	}
+}
+
+func addTestEvent(t *testing.T, db *DB, fi *FirmwareInfo, device string, status UpdateStatus, at time.Time) {
+	t.Helper()
+	if _, err := db.AddUpdateEvent(&UpdateEvent{
+		FirmwareId: fi.Id,
+		DeviceName: device,
+		Status:     status,
+		CreatedAt:  at,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	db := newTestDB(t)
+	rollouts := &RolloutService{&Config{rolloutMaxFailureRatio: 0.2, rolloutMinReports: 5}, db}
+	fi := addTestFirmware(t, db, "repo", "1.0.0", []string{"board"})
+	if _, err := rollouts.SetPercentage(fi, 50, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	report := func(status UpdateStatus, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			addTestEvent(t, db, fi, fmt.Sprintf("%s-%s-%d", status, time.Now().Format(time.RFC3339Nano), i), status, time.Now())
+		}
+	}
+	paused := func() bool {
+		t.Helper()
+		if err := rollouts.CheckHealth(fi); err != nil {
+			t.Fatal(err)
+		}
+		r, err := rollouts.GetRollout(fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Paused
+	}
+
+	// Everything below usually happens within a few milliseconds, outcomes reported
+	// right before resuming must not be counted after it.
+
+	// Downloads and installs in progress are not finished updates.
+	report(UpdateDownloading, 10)
+	report(UpdateInstalled, 10)
+	report(UpdateFailed, 4)
+	if paused() {
+		t.Fatal("paused with fewer than minReports finished updates")
+	}
+
+	// 4 of 20 failed is exactly maxFailureRatio.
+	report(UpdateBooted, 16)
+	if paused() {
+		t.Fatal("paused at maxFailureRatio")
+	}
+
+	report(UpdateRolledBack, 1)
+	if !paused() {
+		t.Fatal("not paused above maxFailureRatio")
+	}
+
+	if _, err := rollouts.Resume(fi, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if paused() {
+		t.Fatal("paused again by outcomes reported before resuming")
+	}
+
+	report(UpdateFailed, 4)
+	if paused() {
+		t.Fatal("paused with fewer than minReports finished updates since resuming")
+	}
+	report(UpdateFailed, 1)
+	if !paused() {
+		t.Fatal("not paused by outcomes reported since resuming")
+	}
+}
+
+func TestGetUpdateStatsAfterEvent(t *testing.T) {
+	db := newTestDB(t)
+	fi := addTestFirmware(t, db, "repo", "1.0.0", []string{"board"})
+	other := addTestFirmware(t, db, "repo", "1.1.0", []string{"board"})
+
+	// All within the same millisecond, events are told apart by id.
+	now := time.Now()
+	addTestEvent(t, db, fi, "board-0", UpdateFailed, now)
+	addTestEvent(t, db, fi, "board-1", UpdateBooted, now)
+	last, err := db.GetLastUpdateEventId(fi.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestEvent(t, db, other, "board-2", UpdateFailed, now)
+	addTestEvent(t, db, fi, "board-1", UpdateRolledBack, now)
+	addTestEvent(t, db, fi, "board-2", UpdateDownloading, now)
+	addTestEvent(t, db, fi, "board-2", UpdateBooted, now)
+
+	tests := []struct {
+		after    int64
+		byStatus map[UpdateStatus]int
+	}{
+		{0, map[UpdateStatus]int{UpdateFailed: 1, UpdateRolledBack: 1, UpdateBooted: 1}},
+		{last, map[UpdateStatus]int{UpdateRolledBack: 1, UpdateBooted: 1}},
+	}
+	for _, tt := range tests {
+		stats, err := db.GetUpdateStats(fi.Id, tt.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices := 0
+		for _, n := range tt.byStatus {
+			devices += n
+		}
+		if stats.Devices != devices || !maps.Equal(stats.ByStatus, tt.byStatus) {
+			t.Errorf("GetUpdateStats(after %d) = %+v, want %v", tt.after, stats, tt.byStatus)
+		}
+	}
+
+	if id, err := db.GetLastUpdateEventId(-1); err != nil || id != 0 {
+		t.Errorf("GetLastUpdateEventId() of firmware without events = %d, %v", id, err)
+	}
+}
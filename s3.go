@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Client of the S3 REST API signed with AWS Signature Version 4, just enough to keep
+// objects in AWS S3, MinIO and other compatible storages.
+
+const (
+	S3_ALGORITHM     = "AWS4-HMAC-SHA256"
+	S3_TIME_FORMAT   = "20060102T150405Z"
+	S3_DATE_FORMAT   = "20060102"
+	S3_EMPTY_PAYLOAD = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // SHA-256 of nothing
+)
+
+type S3Storage struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	prefix          string
+	accessKey       string
+	secretKey       string
+	pathStyle       bool
+	presign         bool
+	presignLifetime time.Duration
+	client          *http.Client
+}
+
+type S3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with status %d", e.Status)
+	}
+	return fmt.Sprintf("S3 request failed with status %d: %s %s", e.Status, e.Code, e.Message)
+}
+
+func NewS3Storage(cfg *Config) (*S3Storage, error) {
+	endpoint, err := url.Parse(cfg.s3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Host == "" || cfg.s3Bucket == "" {
+		return nil, errors.New("s3.endpoint and s3.bucket are required for s3 storage backend")
+	}
+
+	return &S3Storage{
+		endpoint:        endpoint,
+		region:          cfg.s3Region,
+		bucket:          cfg.s3Bucket,
+		prefix:          cfg.s3Prefix,
+		accessKey:       cfg.s3AccessKey,
+		secretKey:       cfg.s3SecretKey,
+		pathStyle:       cfg.s3PathStyle,
+		presign:         cfg.s3PresignDownloads,
+		presignLifetime: cfg.s3PresignLifetime,
+		client:          &http.Client{},
+	}, nil
+}
+
+// URI encoding required by Signature Version 4: everything but unreserved characters is escaped.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Returns host and escaped path of the object.
+func (s *S3Storage) objectLocation(key string) (string, string) {
+	path := "/" + s3Escape(s.prefix+key, true)
+	if s.pathStyle {
+		return s.endpoint.Host, "/" + s3Escape(s.bucket, false) + path
+	}
+	return s.bucket + "." + s.endpoint.Host, path
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *S3Storage) credentialScope(t time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", t.Format(S3_DATE_FORMAT), s.region)
+}
+
+func (s *S3Storage) signature(t time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		S3_ALGORITHM,
+		t.Format(S3_TIME_FORMAT),
+		s.credentialScope(t),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+s.secretKey), t.Format(S3_DATE_FORMAT))
+	key = hmacSha256(key, s.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	return hex.EncodeToString(hmacSha256(key, stringToSign))
+}
+
+// Signs request without query params with Authorization header, all headers set
+// on the request are signed.
+func (s *S3Storage) sign(req *http.Request, payloadHash string, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.Format(S3_TIME_FORMAT))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		names = append(names, lower)
+		values[lower] = strings.TrimSpace(req.Header.Get(name))
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		S3_ALGORITHM, s.accessKey, s.credentialScope(t), signedHeaders, s.signature(t, canonicalRequest)))
+}
+
+// Sends signed request for the object, statuses other than 2xx are returned as errors.
+func (s *S3Storage) request(method string, key string, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	host, path := s.objectLocation(key)
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", s.endpoint.Scheme, host, path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &ObjectNotFoundError{key}
+	}
+	s3err := &S3Error{Status: resp.StatusCode}
+	// HEAD responses and some proxies have no error document.
+	xml.NewDecoder(resp.Body).Decode(s3err)
+	return nil, s3err
+}
+
+func (s *S3Storage) PutFile(key string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	resp, err := s.request(http.MethodPut, key, f, size, hex.EncodeToString(h.Sum(nil)), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return os.Remove(path)
+}
+
+func (s *S3Storage) Put(key string, data []byte) error {
+	hash := sha256.Sum256(data)
+	resp, err := s.request(http.MethodPut, key, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(hash[:]), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3Storage) size(key string) (int64, error) {
+	resp, err := s.request(http.MethodHead, key, nil, 0, S3_EMPTY_PAYLOAD, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (s *S3Storage) Open(key string) (io.ReadSeekCloser, error) {
+	size, err := s.size(key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{s: s, key: key, size: size}, nil
+}
+
+func (s *S3Storage) Exists(key string) (bool, error) {
+	_, err := s.size(key)
+	if _, ok := err.(*ObjectNotFoundError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.request(http.MethodDelete, key, nil, 0, S3_EMPTY_PAYLOAD, nil)
+	if _, ok := err.(*ObjectNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Presigned GET URL valid for s3.presignLifetime, signed with query params.
+func (s *S3Storage) PresignGet(key string) (string, error) {
+	if !s.presign {
+		return "", nil
+	}
+	return s.presignGet(key, time.Now().UTC()), nil
+}
+
+func (s *S3Storage) presignGet(key string, t time.Time) string {
+	host, path := s.objectLocation(key)
+	// Params are in the sorted order required by the canonical request.
+	query := strings.Join([]string{
+		"X-Amz-Algorithm=" + S3_ALGORITHM,
+		"X-Amz-Credential=" + s3Escape(s.accessKey+"/"+s.credentialScope(t), false),
+		"X-Amz-Date=" + t.Format(S3_TIME_FORMAT),
+		fmt.Sprintf("X-Amz-Expires=%d", int(s.presignLifetime.Seconds())),
+		"X-Amz-SignedHeaders=host",
+	}, "&")
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		path,
+		query,
+		"host:" + host,
+		"",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s",
+		s.endpoint.Scheme, host, path, query, s.signature(t, canonicalRequest))
+}
+
+// Object read with ranged GET requests, so seeking (e.g. by http.ServeContent
+// for Range requests) doesn't download the skipped part.
+type s3Object struct {
+	s      *S3Storage
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.s.request(http.MethodGet, o.key, nil, 0, S3_EMPTY_PAYLOAD, header)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek to negative position")
+	}
+
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Permission string
+
+const (
+	// Grants every permission on every repo.
+	PermAdmin Permission = "admin"
+	// View firmwares and download their binaries.
+	PermRead Permission = "read"
+	// Create firmwares and upload their binaries.
+	PermUpload Permission = "upload"
+	// Request the latest firmware as a board named after the token subject.
+	PermBoard Permission = "board"
+)
+
+const AnyRepo = "*"
+
+// Scope is encoded as "<permission>:<repo>" ("admin" has no repo part), repo may be "*".
+type Scope struct {
+	perm Permission
+	repo string
+}
+
+type InvalidScopeError struct {
+	scope string
+}
+
+func (e *InvalidScopeError) Error() string {
+	return fmt.Sprintf("invalid scope '%s'", e.scope)
+}
+
+func ParseScope(s string) (Scope, error) {
+	if s == string(PermAdmin) {
+		return Scope{PermAdmin, ""}, nil
+	}
+
+	perm, repo, ok := strings.Cut(s, ":")
+	if !ok || repo == "" || strings.ContainsAny(repo, " :") {
+		return Scope{}, &InvalidScopeError{s}
+	}
+
+	switch Permission(perm) {
+	case PermRead, PermUpload, PermBoard:
+		return Scope{Permission(perm), repo}, nil
+	default:
+		return Scope{}, &InvalidScopeError{s}
+	}
+}
+
+func (s Scope) String() string {
+	if s.perm == PermAdmin {
+		return string(PermAdmin)
+	}
+	return fmt.Sprintf("%s:%s", s.perm, s.repo)
+}
+
+// Scopes are stored in the "scope" claim and in the db as a space-separated list.
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	for _, str := range strings.Fields(s) {
+		scope, err := ParseScope(str)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+func FormatScopes(scopes []Scope) string {
+	strs := make([]string, len(scopes))
+	for i, scope := range scopes {
+		strs[i] = scope.String()
+	}
+	return strings.Join(strs, " ")
+}
+
+func (s Scope) allows(perm Permission, repo string) bool {
+	if s.perm == PermAdmin {
+		return true
+	}
+	return s.perm == perm && (s.repo == AnyRepo || s.repo == repo)
+}
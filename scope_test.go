@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		s     string
+		scope Scope
+		ok    bool
+	}{
+		{"admin", Scope{PermAdmin, ""}, true},
+		{"read:repoA", Scope{PermRead, "repoA"}, true},
+		{"upload:*", Scope{PermUpload, AnyRepo}, true},
+		{"board:repo-b_1.x", Scope{PermBoard, "repo-b_1.x"}, true},
+		{"admin:repoA", Scope{}, false},
+		{"read", Scope{}, false},
+		{"read:", Scope{}, false},
+		{"read:a:b", Scope{}, false},
+		{"write:repoA", Scope{}, false},
+		{"READ:repoA", Scope{}, false},
+		{":repoA", Scope{}, false},
+		{"", Scope{}, false},
+	}
+
+	for _, tt := range tests {
+		scope, err := ParseScope(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseScope(%q) error = %v, want ok = %v", tt.s, err, tt.ok)
+			continue
+		}
+		if scope != tt.scope {
+			t.Errorf("ParseScope(%q) = %+v, want %+v", tt.s, scope, tt.scope)
+		}
+		if tt.ok && scope.String() != tt.s {
+			t.Errorf("ParseScope(%q).String() = %q", tt.s, scope.String())
+		}
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("  read:*  upload:repoA\tadmin ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatScopes(scopes); got != "read:* upload:repoA admin" {
+		t.Errorf("FormatScopes() = %q", got)
+	}
+
+	if _, err := ParseScopes("read:* bogus"); err == nil {
+		t.Error("ParseScopes() accepted an invalid scope")
+	}
+	if scopes, err := ParseScopes(""); err != nil || len(scopes) != 0 {
+		t.Errorf("ParseScopes(\"\") = %v, %v", scopes, err)
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		scope string
+		perm  Permission
+		repo  string
+		want  bool
+	}{
+		{"admin", PermRead, "repoA", true},
+		{"admin", PermBoard, AnyRepo, true},
+		{"read:repoA", PermRead, "repoA", true},
+		{"read:repoA", PermRead, "repoB", false},
+		{"read:repoA", PermUpload, "repoA", false},
+		{"read:*", PermRead, "repoB", true},
+		{"read:*", PermUpload, "repoB", false},
+		// Scope for one repo doesn't grant the permission for every repo.
+		{"read:repoA", PermRead, AnyRepo, false},
+		{"upload:*", PermUpload, AnyRepo, true},
+		{"board:repoA", PermBoard, "repoA", true},
+		{"board:repoA", PermRead, "repoA", false},
+	}
+
+	for _, tt := range tests {
+		scope, err := ParseScope(tt.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := scope.allows(tt.perm, tt.repo); got != tt.want {
+			t.Errorf("%s allows(%s, %s) = %v, want %v", tt.scope, tt.perm, tt.repo, got, tt.want)
+		}
+	}
+}
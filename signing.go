@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Firmware binaries are signed with a single Ed25519 key, so bootloaders with the
+// public key built in can check them regardless of the transport. The signature
+// is made over the raw 32 byte SHA-256 digest of the binary.
+
+// Key generated by the server if firmware.signingKey is not configured,
+// kept next to token signing keys.
+const FIRMWARE_SIGNING_KEY_FILENAME = "firmware.pem"
+
+type FirmwareSigner struct {
+	kid     string
+	private ed25519.PrivateKey
+}
+
+type InvalidFirmwareSigningKeyError struct {
+	path string
+}
+
+func (e *InvalidFirmwareSigningKeyError) Error() string {
+	return fmt.Sprintf("firmware signing key %s is not an Ed25519 key", e.path)
+}
+
+// Loads the offline-provided key from firmware.signingKey, or the server-held
+// key from storage, generating it on the first start.
+func NewFirmwareSigner(cfg *Config) (*FirmwareSigner, error) {
+	path := cfg.firmwareSigningKey
+	if path == "" {
+		path = filepath.Join(cfg.storagePath, SIGNING_KEYS_DIRNAME, FIRMWARE_SIGNING_KEY_FILENAME)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			_, key, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				return nil, err
+			}
+			if err := writePrivateKeyFile(path, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	key, err := readPrivateKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, &InvalidFirmwareSigningKeyError{path}
+	}
+
+	kid, err := keyId(private)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FirmwareSigner{kid, private}, nil
+}
+
+// Returns hex encoded signature of the binary with given hex encoded SHA-256.
+func (s *FirmwareSigner) Sign(sha256Hex string) (string, error) {
+	digest, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ed25519.Sign(s.private, digest)), nil
+}
+
+func (s *FirmwareSigner) Kid() string {
+	return s.kid
+}
+
+// Returns public key as PKIX PEM.
+func (s *FirmwareSigner) PublicKeyPem() (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(s.private.Public())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backend keeping binaries, compressed variants and patches. Keys are slash-separated
+// paths like blobs/ab/ab12...; the database, keys and unfinished uploads always stay in storagePath.
+type Storage interface {
+	// Moves local file into storage under key.
+	PutFile(key string, path string) error
+	Put(key string, data []byte) error
+	// Returns ObjectNotFoundError if there is no such object.
+	Open(key string) (io.ReadSeekCloser, error)
+	Exists(key string) (bool, error)
+	// Does nothing if there is no such object.
+	Delete(key string) error
+	// Returns URL the object can be downloaded from without the server, empty if
+	// downloads are not redirected.
+	PresignGet(key string) (string, error)
+}
+
+const (
+	StorageBackendFs = "fs"
+	StorageBackendS3 = "s3"
+)
+
+type ObjectNotFoundError struct {
+	key string
+}
+
+func (e *ObjectNotFoundError) Error() string {
+	return fmt.Sprintf("object '%s' not found in storage", e.key)
+}
+
+type UnsupportedStorageBackendError struct {
+	backend string
+}
+
+func (e *UnsupportedStorageBackendError) Error() string {
+	return fmt.Sprintf("unsupported storage backend '%s', use fs or s3", e.backend)
+}
+
+func NewStorage(cfg *Config) (Storage, error) {
+	switch cfg.storageBackend {
+	case StorageBackendFs:
+		return &FileStorage{cfg.storagePath}, nil
+	case StorageBackendS3:
+		return NewS3Storage(cfg)
+	default:
+		return nil, &UnsupportedStorageBackendError{cfg.storageBackend}
+	}
+}
+
+// Keeps objects as files under root.
+type FileStorage struct {
+	root string
+}
+
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *FileStorage) PutFile(key string, path string) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(key)), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(path, s.path(key))
+}
+
+// Writes through a temporary file, so a partially written object is never read.
+func (s *FileStorage) Put(key string, data []byte) error {
+	f, err := os.CreateTemp(s.root, "write-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.PutFile(key, f.Name())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *FileStorage) Open(key string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, &ObjectNotFoundError{key}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *FileStorage) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *FileStorage) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStorage) PresignGet(key string) (string, error) {
+	return "", nil
+}
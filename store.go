@@ -0,0 +1,96 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Persistence of firmwares, tokens, keys, devices and rollouts, implemented by DB
+// for SQLite and PostgreSQL. Binaries themselves are kept in Storage.
+type Store interface {
+	// Returns VersionAlreadyExistsError if the repo has a firmware with the same versionKey.
+	AddFirmwareInfo(info *FirmwareInfo) (*FirmwareInfo, error)
+	GetRolloutCandidates(repo string, board string, channels []Channel) ([]RolloutCandidate, error)
+	FirmwareVersionExists(repo string, versionKey string) (bool, error)
+	// Returns nil if there is no such firmware.
+	GetFirmareInfoByUuid(uuid string) (*FirmwareInfo, error)
+	GetFirmwareInfoByVersion(repo string, versionKey string) (*FirmwareInfo, error)
+	GetDeltaBases(fi *FirmwareInfo, limit int) ([]FirmwareInfo, error)
+	AddDelta(d *Delta) error
+	GetDelta(firmwareId int64, baseFirmwareId int64) (*Delta, error)
+	GetAllFirmwaresInfo() ([]FirmwareInfo, error)
+	ListFirmwaresInfo(filter *FirmwareFilter, sort FirmwareSort, after *FirmwareCursor, limit int) ([]FirmwareInfo, error)
+	// Also adds fi.Variants. Returns FirmwareFileAlreadyUploaded if the firmware has a binary.
+	UpdateFirmwareFileInfo(fi *FirmwareInfo) error
+	SetFirmwareSha256(firmwareId int64, sha256 string) error
+	AcquireBlob(sha256 string, size int64) (int64, error)
+	ReleaseBlob(sha256 string) (int64, error)
+
+	AddTokenRecord(tr *TokenRecord) (*TokenRecord, error)
+	// Returns nil if there is no such token.
+	GetTokenRecordByJti(jti string) (*TokenRecord, error)
+	GetAllTokenRecords() ([]TokenRecord, error)
+	RevokeToken(jti string, revokedAt time.Time) (bool, error)
+
+	AddSigningKeyRecord(kr *SigningKeyRecord) (*SigningKeyRecord, error)
+	GetSigningKeyRecordByKid(kid string) (*SigningKeyRecord, error)
+	GetActiveSigningKeyRecord() (*SigningKeyRecord, error)
+	GetAllSigningKeyRecords() ([]SigningKeyRecord, error)
+	RetireSigningKeys(exceptKid string, retiresAt time.Time) error
+
+	AddDeveloperKeyRecord(kr *DeveloperKeyRecord) (*DeveloperKeyRecord, error)
+	DeveloperKeyExists(kid string) (bool, error)
+	GetActiveDeveloperKeyRecords(subject string) ([]DeveloperKeyRecord, error)
+	GetAllDeveloperKeyRecords() ([]DeveloperKeyRecord, error)
+	RevokeDeveloperKey(kid string, revokedAt time.Time) (bool, error)
+
+	UpsertDeviceInfo(di *DeviceInfo) error
+	GetAllDevicesInfo() ([]DeviceInfo, error)
+	AddUpdateEvent(ue *UpdateEvent) (*UpdateEvent, error)
+	GetLastUpdateEventId(firmwareId int64) (int64, error)
+	GetUpdateStats(firmwareId int64, afterEvent int64) (*UpdateStats, error)
+
+	SetBoardSubscription(sub *BoardSubscription) error
+	GetBoardSubscription(board string, repo string) (*BoardSubscription, error)
+	GetBoardSubscriptions(board string) ([]BoardSubscription, error)
+	SetRollout(r *Rollout) error
+	GetRollout(firmwareId int64) (*Rollout, error)
+
+	AddUploadSession(us *UploadSession) error
+	GetUploadSession(id string) (*UploadSession, error)
+	GetUploadSessionsCreatedBefore(t time.Time) ([]UploadSession, error)
+	DeleteUploadSession(id string) error
+
+	GetMigrationStatus() ([]MigrationStatus, error)
+	Migrate() ([]Migration, error)
+	DataMigrationApplied(name string) (bool, error)
+	SetDataMigrationApplied(name string) error
+}
+
+type Dialect string
+
+// Also names of the database/sql drivers.
+const (
+	DialectSqlite   Dialect = "sqlite3"
+	DialectPostgres Dialect = "postgres"
+)
+
+// Connection parameters of libpq understood by lib/pq, a DSN starting with one of them
+// is a key=value connection string.
+var LIBPQ_PARAMS = []string{
+	"host", "hostaddr", "port", "dbname", "user", "password", "sslmode", "sslcert", "sslkey",
+	"sslrootcert", "sslinline", "connect_timeout", "application_name", "fallback_application_name",
+}
+
+// PostgreSQL is used for postgres:// URLs and libpq key=value connection strings
+// (host=db dbname=ota ...), anything else is a path to SQLite database.
+func dialectOf(dsn string) Dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return DialectPostgres
+	}
+	if key, _, ok := strings.Cut(strings.TrimSpace(dsn), "="); ok && slices.Contains(LIBPQ_PARAMS, strings.TrimSpace(key)) {
+		return DialectPostgres
+	}
+	return DialectSqlite
+}
@@ -0,0 +1,33 @@
+-- Database of the server before migrations were introduced (schema of fe85fb7),
+-- TestMigrateBaseline upgrades it to the current version.
+CREATE TABLE IF NOT EXISTS firmwares (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid        TEXT UNIQUE NOT NULL,
+    repoName    TEXT NOT NULL,
+    commitId    TEXT NOT NULL,
+    createdAt   DATETIME NOT NULL,
+    createdBy   TEXT NOT NULL,
+    md5         TEXT NOT NULL,
+    description TEXT NOT NULL,
+    size        INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS boards (
+    boardName   TEXT NOT NULL,
+    firmwareId  INTEGER NOT NULL
+);
+
+INSERT INTO firmwares (uuid, repoName, commitId, createdAt, createdBy, md5, description, size) VALUES
+    ('0b6f0d6c-8d7e-4b7a-9a51-4a3b1c1e0001', 'repoA', 'a1b2c3d', '2023-03-01 10:00:00+00:00', 'alice',
+     '9e107d9d372bb6826bd81d3542a419d6', 'first release', 1024),
+    ('0b6f0d6c-8d7e-4b7a-9a51-4a3b1c1e0002', 'repoA', 'e4f5a6b', '2023-03-02 11:30:00+03:00', 'bob',
+     'e4d909c290d0fb1ca068ffaddf22cbd0', 'fixes', 2048),
+    ('0b6f0d6c-8d7e-4b7a-9a51-4a3b1c1e0003', 'repoB', 'c7d8e9f', '2023-03-03 09:15:00+00:00', 'alice',
+     'd41d8cd98f00b204e9800998ecf8427e', '', 0);
+
+INSERT INTO boards (boardName, firmwareId) VALUES
+    ('board-1', 1),
+    ('board-2', 1),
+    ('board-1', 2),
+    ('board-1', 2), -- duplicate, dropped by migration 2
+    ('board-3', 3),
+    ('board-4', 42); -- firmware doesn't exist, dropped by migration 2
@@ -1,30 +1,159 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"github.com/golang-jwt/jwt/v5"
+	"net/url"
 	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	guuid "github.com/google/uuid"
 )
 
 type TokenService struct {
-	cfg *Config
+	cfg  *Config
+	db   Store
+	keys *SigningKeysService
 }
 
 type TokenSubject struct {
-	name    string
-	isBoard bool
+	name   string
+	scopes []Scope
+}
+
+func (sub *TokenSubject) can(perm Permission, repo string) bool {
+	for _, scope := range sub.scopes {
+		if scope.allows(perm, repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether subject has given permission for at least one repo.
+func (sub *TokenSubject) canAny(perm Permission) bool {
+	for _, scope := range sub.scopes {
+		if scope.perm == PermAdmin || scope.perm == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns repos subject has given permission for, nil if it has it for any repo.
+func (sub *TokenSubject) reposWith(perm Permission) []string {
+	repos := []string{}
+	for _, scope := range sub.scopes {
+		if scope.allows(perm, AnyRepo) {
+			return nil
+		}
+		if scope.perm == perm {
+			repos = append(repos, scope.repo)
+		}
+	}
+	return repos
+}
+
+func (sub *TokenSubject) isBoard() bool {
+	for _, scope := range sub.scopes {
+		if scope.perm == PermBoard {
+			return true
+		}
+	}
+	return false
+}
+
+func (svc *TokenService) lifetime(sub *TokenSubject) time.Duration {
+	if sub.isBoard() {
+		return svc.cfg.jwtBoardLifetime
+	}
+	return svc.cfg.jwtLifetime
 }
 
+// Issues new token and records it in the tokens table, so it can be revoked later.
 func (svc *TokenService) New(sub *TokenSubject) (string, error) {
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"iss":   svc.cfg.jwtIssuer,
-			"sub":   sub.name,
-			"board": sub.isBoard,
-		})
+	now := time.Now()
+	tr := TokenRecord{
+		Jti:       guuid.New().String(),
+		Subject:   sub.name,
+		Scope:     FormatScopes(sub.scopes),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(svc.lifetime(sub)),
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   svc.cfg.jwtIssuer,
+		"sub":   tr.Subject,
+		"scope": tr.Scope,
+		"jti":   tr.Jti,
+		"iat":   tr.IssuedAt.Unix(),
+		"exp":   tr.ExpiresAt.Unix(),
+	}
+	tokenStr, err := svc.sign(claims)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := svc.db.AddTokenRecord(&tr); err != nil {
+		return "", err
+	}
+
+	return tokenStr, nil
+}
+
+type NoSigningKeyError struct{}
+
+func (e *NoSigningKeyError) Error() string {
+	return "no signing key: generate one with 'key rotate' or set jwt.signingKey"
+}
+
+// Signs with the active asymmetric key, falls back to the legacy HS256 secret
+// from the config if no key has been generated yet.
+func (svc *TokenService) sign(claims jwt.MapClaims) (string, error) {
+	key, err := svc.keys.SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	if key != nil {
+		t := jwt.NewWithClaims(key.method, claims)
+		t.Header["kid"] = key.kid
+		return t.SignedString(key.private)
+	}
+
+	if svc.cfg.jwtSigningKey == "" {
+		return "", &NoSigningKeyError{}
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return t.SignedString([]byte(svc.cfg.jwtSigningKey))
 }
 
+// Tokens with "kid" header are verified with the corresponding (not yet retired) key,
+// tokens without it are verified with the legacy HS256 secret if it is still configured.
+func (svc *TokenService) verificationKey(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if svc.cfg.jwtSigningKey == "" || token.Method != jwt.SigningMethodHS256 {
+			return nil, &SigningKeyNotFoundError{""}
+		}
+		return []byte(svc.cfg.jwtSigningKey), nil
+	}
+
+	key, err := svc.keys.VerificationKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, &SigningKeyNotFoundError{kid}
+	}
+
+	return key.private.Public(), nil
+}
+
 type InvalidTokenClaimsError struct {
 	claim string
 }
@@ -36,6 +165,18 @@ func (e *InvalidTokenClaimsError) Error() string {
 	)
 }
 
+type TokenRevokedError struct{}
+
+func (e *TokenRevokedError) Error() string {
+	return "token is revoked or unknown"
+}
+
+type TokenNotFoundError struct{}
+
+func (e *TokenNotFoundError) Error() string {
+	return "token not found or already revoked"
+}
+
 func verifyClaimType(claims jwt.MapClaims, key string, typeStr string) error {
 	if _, ok := claims[key]; !ok {
 		return &InvalidTokenClaimsError{key}
@@ -46,15 +187,40 @@ func verifyClaimType(claims jwt.MapClaims, key string, typeStr string) error {
 	return nil
 }
 
+// Tokens issued before scopes and the registry were introduced carry only a board
+// flag, with no exp, jti and scope. They are verified with jwt.signingKey (no kid)
+// and accepted only with jwt.acceptLegacyTokens, since they never expire.
+func legacyTokenSubject(claims jwt.MapClaims) (*TokenSubject, error) {
+	if err := verifyClaimType(claims, "board", "bool"); err != nil {
+		return nil, err
+	}
+
+	scopes := []Scope{{PermRead, AnyRepo}, {PermUpload, AnyRepo}}
+	if claims["board"].(bool) {
+		scopes = []Scope{{PermBoard, AnyRepo}}
+	}
+	return &TokenSubject{
+		name:   claims["sub"].(string),
+		scopes: scopes,
+	}, nil
+}
+
 func (svc *TokenService) ParseToken(tokenStr string) (*TokenSubject, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{
+			jwt.SigningMethodHS256.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+			jwt.SigningMethodES256.Alg(),
+		}),
+		jwt.WithIssuedAt(),
+	}
+	// Otherwise exp is checked below for all but legacy tokens.
+	if !svc.cfg.jwtAcceptLegacyTokens {
+		opts = append(opts, jwt.WithExpirationRequired())
+	}
+
 	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(
-		tokenStr,
-		claims,
-		func(token *jwt.Token) (any, error) {
-			return []byte(svc.cfg.jwtSigningKey), nil
-		},
-	)
+	token, err := jwt.ParseWithClaims(tokenStr, claims, svc.verificationKey, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -65,12 +231,103 @@ func (svc *TokenService) ParseToken(tokenStr string) (*TokenSubject, error) {
 	if err = verifyClaimType(claims, "sub", "string"); err != nil {
 		return nil, err
 	}
-	if err = verifyClaimType(claims, "board", "bool"); err != nil {
+
+	_, hasKid := token.Header["kid"]
+	_, hasJti := claims["jti"]
+	if svc.cfg.jwtAcceptLegacyTokens && !hasKid && !hasJti {
+		return legacyTokenSubject(claims)
+	}
+
+	if err = verifyClaimType(claims, "exp", "float64"); err != nil {
+		return nil, err
+	}
+	if err = verifyClaimType(claims, "scope", "string"); err != nil {
 		return nil, err
 	}
+	if err = verifyClaimType(claims, "jti", "string"); err != nil {
+		return nil, err
+	}
+
+	tr, err := svc.db.GetTokenRecordByJti(claims["jti"].(string))
+	if err != nil {
+		return nil, err
+	}
+	if tr == nil || tr.isRevoked() {
+		return nil, &TokenRevokedError{}
+	}
+
+	scopes, err := ParseScopes(claims["scope"].(string))
+	if err != nil {
+		return nil, &InvalidTokenClaimsError{"scope"}
+	}
 
 	return &TokenSubject{
-		name:    claims["sub"].(string),
-		isBoard: claims["board"].(bool),
+		name:   claims["sub"].(string),
+		scopes: scopes,
 	}, nil
 }
+
+func (svc *TokenService) GetAllTokens() ([]TokenRecord, error) {
+	return svc.db.GetAllTokenRecords()
+}
+
+func (svc *TokenService) Revoke(jti string) error {
+	ok, err := svc.db.RevokeToken(jti, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &TokenNotFoundError{}
+	}
+	return nil
+}
+
+type InvalidBinUrlError struct {
+	reason string
+}
+
+func (e *InvalidBinUrlError) Error() string {
+	return fmt.Sprintf("invalid download URL: %s", e.reason)
+}
+
+func (svc *TokenService) binUrlSignature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(svc.cfg.binUrlSigningKey))
+	fmt.Fprintf(mac, "%s\n%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns query params for a short-lived download URL of the file with given path under /bin/
+// (uuid for firmware binaries), nil if URL signing is not configured.
+func (svc *TokenService) SignBinUrl(path string) url.Values {
+	if svc.cfg.binUrlSigningKey == "" {
+		return nil
+	}
+
+	expires := time.Now().Add(svc.cfg.binUrlLifetime).Unix()
+	return url.Values{
+		"expires":   {strconv.FormatInt(expires, 10)},
+		"signature": {svc.binUrlSignature(path, expires)},
+	}
+}
+
+func (svc *TokenService) VerifyBinUrl(path string, expiresStr string, signature string) error {
+	if svc.cfg.binUrlSigningKey == "" {
+		return &InvalidBinUrlError{"signed URLs are disabled"}
+	}
+
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return &InvalidBinUrlError{"bad expiration time"}
+	}
+
+	expected := svc.binUrlSignature(path, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return &InvalidBinUrlError{"signature mismatch"}
+	}
+
+	if time.Now().Unix() > expires {
+		return &InvalidBinUrlError{"URL is expired"}
+	}
+
+	return nil
+}
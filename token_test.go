@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	guuid "github.com/google/uuid"
+)
+
+func newTestTokenService(t *testing.T) *TokenService {
+	t.Helper()
+	cfg := &Config{
+		storagePath:      t.TempDir(),
+		jwtSigningKey:    "secret",
+		jwtIssuer:        "ota-server",
+		jwtLifetime:      time.Hour,
+		jwtBoardLifetime: 24 * time.Hour,
+		jwtKeyAlgorithm:  "EdDSA",
+	}
+	db := newTestDB(t)
+	return &TokenService{cfg, db, NewSigningKeysService(cfg, db)}
+}
+
+func newTestToken(t *testing.T, svc *TokenService, scopes string) string {
+	t.Helper()
+	parsed, err := ParseScopes(scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := svc.New(&TokenSubject{"sub", parsed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func jtiOf(t *testing.T, token string) string {
+	t.Helper()
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims["jti"].(string)
+}
+
+func TestParseTokenRevoked(t *testing.T) {
+	svc := newTestTokenService(t)
+	token := newTestToken(t, svc, "read:repoA")
+
+	sub, err := svc.ParseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.name != "sub" || !sub.can(PermRead, "repoA") || sub.can(PermRead, "repoB") {
+		t.Errorf("ParseToken() = %+v", sub)
+	}
+
+	if err := svc.Revoke(jtiOf(t, token)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ParseToken(token); !errors.As(err, new(*TokenRevokedError)) {
+		t.Errorf("ParseToken() of revoked token error = %v, want TokenRevokedError", err)
+	}
+}
+
+// Adds jti of a token recorded in the registry to the claims.
+func recordTestToken(t *testing.T, svc *TokenService, claims jwt.MapClaims) {
+	t.Helper()
+	jti := guuid.New().String()
+	claims["jti"] = jti
+	if _, err := svc.db.AddTokenRecord(&TokenRecord{
+		Jti:       jti,
+		Subject:   "sub",
+		Scope:     "read:*",
+		IssuedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Signs claims of a token recorded in the registry, so only the claims make it invalid.
+func signRecordedToken(t *testing.T, svc *TokenService, claims jwt.MapClaims) string {
+	t.Helper()
+	recordTestToken(t, svc, claims)
+	token, err := svc.sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParseTokenExpiration(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		legacy bool // jwt.acceptLegacyTokens
+	}{
+		{"expired", jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}, false},
+		{"expired with legacy", jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}, true},
+		{"no exp", jwt.MapClaims{}, false},
+		{"no exp with legacy", jwt.MapClaims{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestTokenService(t)
+			svc.cfg.jwtAcceptLegacyTokens = tt.legacy
+
+			tt.claims["iss"] = svc.cfg.jwtIssuer
+			tt.claims["sub"] = "sub"
+			tt.claims["scope"] = "read:*"
+			tt.claims["iat"] = now.Add(-time.Hour).Unix()
+			if sub, err := svc.ParseToken(signRecordedToken(t, svc, tt.claims)); err == nil {
+				t.Errorf("ParseToken() = %+v, want error", sub)
+			}
+		})
+	}
+}
+
+func TestParseTokenLegacy(t *testing.T) {
+	svc := newTestTokenService(t)
+	sign := func(board bool, secret string) string {
+		claims := jwt.MapClaims{"iss": svc.cfg.jwtIssuer, "sub": "legacy", "board": board}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	if sub, err := svc.ParseToken(sign(true, "secret")); err == nil {
+		t.Fatalf("legacy token accepted by default: %+v", sub)
+	}
+
+	svc.cfg.jwtAcceptLegacyTokens = true
+	sub, err := svc.ParseToken(sign(true, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sub.can(PermBoard, "repoA") || sub.can(PermRead, "repoA") {
+		t.Errorf("legacy board token scopes = %v", sub.scopes)
+	}
+
+	sub, err = svc.ParseToken(sign(false, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sub.can(PermUpload, "repoA") || sub.can(PermAdmin, AnyRepo) || sub.isBoard() {
+		t.Errorf("legacy developer token scopes = %v", sub.scopes)
+	}
+
+	if _, err := svc.ParseToken(sign(true, "other secret")); err == nil {
+		t.Error("legacy token signed with another secret accepted")
+	}
+}
+
+func TestSubjectReposWith(t *testing.T) {
+	tests := []struct {
+		scopes string
+		repos  []string // nil for any repo
+	}{
+		{"admin", nil},
+		{"read:*", nil},
+		{"read:repoA upload:repoB read:repoC", []string{"repoA", "repoC"}},
+		{"upload:*", []string{}},
+	}
+
+	for _, tt := range tests {
+		scopes, err := ParseScopes(tt.scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos := (&TokenSubject{"sub", scopes}).reposWith(PermRead)
+		if (repos == nil) != (tt.repos == nil) || len(repos) != len(tt.repos) {
+			t.Errorf("%q reposWith(read) = %#v, want %#v", tt.scopes, repos, tt.repos)
+			continue
+		}
+		for i := range repos {
+			if repos[i] != tt.repos[i] {
+				t.Errorf("%q reposWith(read) = %#v, want %#v", tt.scopes, repos, tt.repos)
+				break
+			}
+		}
+	}
+}
+
+func TestVerifyBinUrl(t *testing.T) {
+	svc := newTestTokenService(t)
+	svc.cfg.binUrlSigningKey = "url secret"
+	svc.cfg.binUrlLifetime = time.Hour
+
+	query := svc.SignBinUrl("firmware-a")
+	expires, signature := query.Get("expires"), query.Get("signature")
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	pastSignature := svc.binUrlSignature("firmware-a", time.Now().Add(-time.Minute).Unix())
+
+	tests := []struct {
+		name      string
+		path      string
+		expires   string
+		signature string
+		ok        bool
+	}{
+		{"valid", "firmware-a", expires, signature, true},
+		{"other firmware", "firmware-b", expires, signature, false},
+		{"tampered signature", "firmware-a", expires, strings.Repeat("0", len(signature)), false},
+		{"truncated signature", "firmware-a", expires, signature[:len(signature)-1], false},
+		{"no signature", "firmware-a", expires, "", false},
+		{"extended expiration", "firmware-a", expires + "0", signature, false},
+		{"expired", "firmware-a", past, pastSignature, false},
+		{"bad expiration", "firmware-a", "soon", signature, false},
+	}
+
+	for _, tt := range tests {
+		err := svc.VerifyBinUrl(tt.path, tt.expires, tt.signature)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: VerifyBinUrl() error = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+
+	svc.cfg.binUrlSigningKey = ""
+	if query := svc.SignBinUrl("firmware-a"); query != nil {
+		t.Errorf("SignBinUrl() without key = %v", query)
+	}
+	if err := svc.VerifyBinUrl("firmware-a", expires, signature); err == nil {
+		t.Error("VerifyBinUrl() accepted a URL with signing disabled")
+	}
+}
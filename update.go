@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+type UpdateService struct {
+	db       Store
+	rollouts *RolloutService
+}
+
+func (svc *UpdateService) ReportEvent(fi *FirmwareInfo, device string, status UpdateStatus, errorCode string) error {
+	if status != UpdateFailed {
+		errorCode = ""
+	}
+
+	_, err := svc.db.AddUpdateEvent(&UpdateEvent{
+		FirmwareId: fi.Id,
+		DeviceName: device,
+		Status:     status,
+		ErrorCode:  errorCode,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if status == UpdateFailed || status == UpdateRolledBack {
+		return svc.rollouts.CheckHealth(fi)
+	}
+	return nil
+}
+
+func (svc *UpdateService) GetStats(fi *FirmwareInfo) (*UpdateStats, error) {
+	return svc.db.GetUpdateStats(fi.Id, 0)
+}
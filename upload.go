@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+// Resumable uploads: a session is created with the declared size (and optionally digests)
+// of the file, chunks are appended to a partial file in storage at the given offsets,
+// and when all of them are uploaded, the session is finalized and the file is added
+// to the firmware the same way as with a single request. Sessions not finalized
+// within upload.sessionLifetime are removed with their partial files.
+
+type UploadNotFoundError struct{}
+
+func (e *UploadNotFoundError) Error() string {
+	return "upload not found"
+}
+
+type UploadSizeMismatchError struct {
+	declared int64
+	uploaded int64
+}
+
+func (e *UploadSizeMismatchError) Error() string {
+	return fmt.Sprintf("uploaded %d bytes, but %d declared", e.uploaded, e.declared)
+}
+
+// Partial file is removed together with the session, so requests racing with
+// abort or expiry of the session find it missing.
+func partialError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return &UploadNotFoundError{}
+	}
+	return err
+}
+
+func (svc *FirmwareService) CreateUpload(info *FirmwareInfo, size int64, expected ExpectedDigests, by string) (*UploadSession, error) {
+	if info.hasBin() {
+		return nil, &FirmwareFileAlreadyUploaded{}
+	}
+
+	us := UploadSession{
+		Id:         guuid.New().String(),
+		FirmwareId: info.Id,
+		Size:       size,
+		Md5:        strings.ToLower(expected.Md5),
+		Sha256:     strings.ToLower(expected.Sha256),
+		CreatedBy:  by,
+		CreatedAt:  time.Now(),
+	}
+	if err := svc.bins.CreatePartial(us.Id); err != nil {
+		return nil, err
+	}
+	if err := svc.db.AddUploadSession(&us); err != nil {
+		svc.bins.RemovePartial(us.Id)
+		return nil, err
+	}
+
+	return &us, nil
+}
+
+// Returns upload session of the firmware and number of bytes uploaded.
+func (svc *FirmwareService) GetUpload(info *FirmwareInfo, id string) (*UploadSession, int64, error) {
+	us, err := svc.db.GetUploadSession(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if us == nil || us.FirmwareId != info.Id || svc.isExpired(us) {
+		return nil, 0, &UploadNotFoundError{}
+	}
+
+	offset, err := svc.bins.PartialSize(id)
+	if err != nil {
+		return nil, 0, partialError(err)
+	}
+
+	return us, offset, nil
+}
+
+// Returns number of bytes uploaded after the chunk is written (or partially written on error).
+// Data beyond the declared size is ignored.
+func (svc *FirmwareService) AppendUploadChunk(us *UploadSession, offset int64, r io.Reader) (int64, error) {
+	uploaded, err := svc.bins.AppendPartial(us.Id, offset, io.LimitReader(r, max(us.Size-offset, 0)))
+	return uploaded, partialError(err)
+}
+
+func (svc *FirmwareService) FinalizeUpload(info *FirmwareInfo, us *UploadSession, devSignature []byte) error {
+	if info.hasBin() {
+		return &FirmwareFileAlreadyUploaded{}
+	}
+
+	sb, err := svc.bins.StagePartial(us.Id)
+	if err != nil {
+		return partialError(err)
+	}
+
+	if sb.Size != us.Size {
+		// Keep the partial file, so the missing chunks can still be uploaded.
+		return &UploadSizeMismatchError{us.Size, sb.Size}
+	}
+
+	// The file is discarded on errors, including digest or signature mismatch, so the session is useless too.
+	if err := svc.addStagedFile(info, sb, ExpectedDigests{us.Md5, us.Sha256}, devSignature); err != nil {
+		svc.db.DeleteUploadSession(us.Id)
+		return err
+	}
+
+	return svc.db.DeleteUploadSession(us.Id)
+}
+
+func (svc *FirmwareService) AbortUpload(us *UploadSession) error {
+	if err := svc.bins.RemovePartial(us.Id); err != nil {
+		return err
+	}
+	return svc.db.DeleteUploadSession(us.Id)
+}
+
+func (svc *FirmwareService) isExpired(us *UploadSession) bool {
+	return time.Since(us.CreatedAt) > svc.cfg.uploadSessionLifetime
+}
+
+// Expired sessions and their partial files are kept at most this much longer.
+const UPLOAD_CLEANUP_INTERVAL = time.Hour
+
+// Removes expired uploads on start and then periodically, never returns.
+func (svc *FirmwareService) RemoveExpiredUploadsPeriodically() {
+	ticker := time.NewTicker(UPLOAD_CLEANUP_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := svc.RemoveExpiredUploads(); err != nil {
+			log.Printf("failed to remove expired uploads: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// Removes sessions not finalized within upload.sessionLifetime and their partial files.
+func (svc *FirmwareService) RemoveExpiredUploads() error {
+	uss, err := svc.db.GetUploadSessionsCreatedBefore(time.Now().Add(-svc.cfg.uploadSessionLifetime))
+	if err != nil {
+		return err
+	}
+
+	for i := range uss {
+		if err := svc.AbortUpload(&uss[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFirmwareService(t *testing.T) *FirmwareService {
+	t.Helper()
+	db := newTestDB(t)
+	cfg := &Config{
+		storagePath:           t.TempDir(),
+		storageBackend:        StorageBackendFs,
+		uploadSessionLifetime: time.Hour,
+	}
+	storage, err := NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FirmwareService{cfg: cfg, db: db, bins: &BinariesService{cfg: cfg, db: db, storage: storage}}
+}
+
+func newTestUpload(t *testing.T, svc *FirmwareService, size int64) (*FirmwareInfo, *UploadSession) {
+	t.Helper()
+	fi := addTestFirmware(t, svc.db.(*DB), "repo", "1.0.0", []string{"board"})
+	fi.Size = 0
+	us, err := svc.CreateUpload(fi, size, ExpectedDigests{}, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi, us
+}
+
+func TestAppendUploadChunkOffset(t *testing.T) {
+	svc := newTestFirmwareService(t)
+	fi, us := newTestUpload(t, svc, 10)
+
+	if n, err := svc.AppendUploadChunk(us, 0, strings.NewReader("abcd")); err != nil || n != 4 {
+		t.Fatalf("AppendUploadChunk() = %d, %v", n, err)
+	}
+
+	// Repeated and skipped chunks don't change the file.
+	for _, offset := range []int64{0, 2, 5} {
+		n, err := svc.AppendUploadChunk(us, offset, strings.NewReader("efgh"))
+		var mismatch *UploadOffsetMismatchError
+		if !errors.As(err, &mismatch) || n != 4 {
+			t.Errorf("AppendUploadChunk() at %d = %d, %v, want UploadOffsetMismatchError at 4", offset, n, err)
+		}
+	}
+
+	// Data beyond the declared size is ignored.
+	if n, err := svc.AppendUploadChunk(us, 4, strings.NewReader("efghijklmn")); err != nil || n != 10 {
+		t.Fatalf("AppendUploadChunk() = %d, %v", n, err)
+	}
+	if _, offset, err := svc.GetUpload(fi, us.Id); err != nil || offset != 10 {
+		t.Errorf("GetUpload() offset = %d, %v, want 10", offset, err)
+	}
+	if data, err := os.ReadFile(svc.bins.partialPath(us.Id)); err != nil || string(data) != "abcdefghij" {
+		t.Errorf("partial file = %q, %v", data, err)
+	}
+}
+
+func TestFinalizeUploadSizeMismatch(t *testing.T) {
+	svc := newTestFirmwareService(t)
+	fi, us := newTestUpload(t, svc, 10)
+
+	if _, err := svc.AppendUploadChunk(us, 0, strings.NewReader("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	err := svc.FinalizeUpload(fi, us, nil)
+	var mismatch *UploadSizeMismatchError
+	if !errors.As(err, &mismatch) || mismatch.uploaded != 4 || mismatch.declared != 10 {
+		t.Fatalf("FinalizeUpload() error = %v, want UploadSizeMismatchError", err)
+	}
+
+	// The upload can be continued.
+	if _, offset, err := svc.GetUpload(fi, us.Id); err != nil || offset != 4 {
+		t.Fatalf("GetUpload() offset = %d, %v, want 4", offset, err)
+	}
+	if n, err := svc.AppendUploadChunk(us, 4, strings.NewReader("efghij")); err != nil || n != 10 {
+		t.Errorf("AppendUploadChunk() = %d, %v", n, err)
+	}
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	svc := newTestFirmwareService(t)
+	fi, expired := newTestUpload(t, svc, 10)
+	svc.cfg.uploadSessionLifetime = 0
+	if _, _, err := svc.GetUpload(fi, expired.Id); !errors.As(err, new(*UploadNotFoundError)) {
+		t.Errorf("GetUpload() of expired session error = %v, want UploadNotFoundError", err)
+	}
+
+	// Sessions are compared by creation time to the millisecond in SQLite.
+	svc.cfg.uploadSessionLifetime = time.Hour
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	active, err := svc.CreateUpload(fi, 10, ExpectedDigests{}, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.cfg.uploadSessionLifetime = time.Since(between)
+	if err := svc.RemoveExpiredUploads(); err != nil {
+		t.Fatal(err)
+	}
+	svc.cfg.uploadSessionLifetime = time.Hour
+
+	if _, err := os.Stat(svc.bins.partialPath(expired.Id)); !os.IsNotExist(err) {
+		t.Errorf("partial file of expired upload: %v", err)
+	}
+	if us, err := svc.db.GetUploadSession(expired.Id); err != nil || us != nil {
+		t.Errorf("expired session: %+v, %v", us, err)
+	}
+	if _, _, err := svc.GetUpload(fi, active.Id); err != nil {
+		t.Errorf("GetUpload() of active session error = %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Semantic version, see https://semver.org
+type Version struct {
+	major, minor, patch uint64
+	prerelease          []string
+	build               string
+}
+
+var versionRegexp = regexp.MustCompile(
+	`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+		`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+		`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`,
+)
+
+type InvalidVersionError struct {
+	version string
+}
+
+func (e *InvalidVersionError) Error() string {
+	return fmt.Sprintf("'%s' is not a valid semantic version (MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD])", e.version)
+}
+
+func ParseVersion(s string) (*Version, error) {
+	m := versionRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, &InvalidVersionError{s}
+	}
+
+	var (
+		v   Version
+		err error
+	)
+	for i, dst := range []*uint64{&v.major, &v.minor, &v.patch} {
+		if *dst, err = strconv.ParseUint(m[i+1], 10, 64); err != nil {
+			return nil, &InvalidVersionError{s}
+		}
+	}
+	if m[4] != "" {
+		v.prerelease = strings.Split(m[4], ".")
+	}
+	v.build = m[5]
+
+	for _, id := range v.prerelease {
+		if isNumericIdentifier(id) && len(id) > 20 {
+			return nil, &InvalidVersionError{s}
+		}
+	}
+
+	return &v, nil
+}
+
+func isNumericIdentifier(id string) bool {
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns string, that compares (as bytes, e.g. with SQL ORDER BY) the same way
+// as versions compare by semver precedence. Build metadata is ignored.
+//
+// Numeric parts are zero-padded. Prerelease identifiers are prefixed with 0 if numeric
+// and 1 otherwise (numeric ones have lower precedence) and joined with space, which is
+// less than any identifier character, so a shorter set of identifiers sorts first.
+// Release gets "~" suffix, which is greater than "-" prerelease suffix.
+func (v *Version) key() string {
+	key := fmt.Sprintf("%020d.%020d.%020d", v.major, v.minor, v.patch)
+	if len(v.prerelease) == 0 {
+		return key + "~"
+	}
+
+	ids := make([]string, len(v.prerelease))
+	for i, id := range v.prerelease {
+		if isNumericIdentifier(id) {
+			ids[i] = fmt.Sprintf("0%020s", id)
+		} else {
+			ids[i] = "1" + id
+		}
+	}
+	return key + "-" + strings.Join(ids, " ")
+}
@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	valid := []string{
+		"0.0.0",
+		"1.2.3",
+		"10.20.30",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-0.3.7",
+		"1.0.0-x.7.z.92",
+		"1.0.0-x-y-z.--",
+		"1.0.0+20130313144700",
+		"1.0.0-beta+exp.sha.5114f85",
+		"1.0.0-rc.1+build.1",
+	}
+	for _, s := range valid {
+		if _, err := ParseVersion(s); err != nil {
+			t.Errorf("ParseVersion(%q) error = %v", s, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"1",
+		"1.2",
+		"1.2.3.4",
+		"v1.2.3",
+		"01.2.3",
+		"1.02.3",
+		"1.2.03",
+		"1.2.3-",
+		"1.2.3-01",
+		"1.2.3-alpha..1",
+		"1.2.3+",
+		"1.2.3+build..1",
+		"1.2.3-alpha_1",
+		"99999999999999999999.0.0",
+		"1.0.0-123456789012345678901",
+	}
+	for _, s := range invalid {
+		if _, err := ParseVersion(s); err == nil {
+			t.Errorf("ParseVersion(%q) accepted an invalid version", s)
+		}
+	}
+}
+
+func versionKey(t *testing.T, s string) string {
+	t.Helper()
+	v, err := ParseVersion(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.key()
+}
+
+func TestVersionKeyOrder(t *testing.T) {
+	// Ascending by semver precedence, the first part is the example from semver.org.
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1-0",
+		"1.0.1-1",
+		"1.0.1-9",
+		"1.0.1-10",
+		"1.0.1-A",
+		"1.0.1-a",
+		"1.0.1-a.0",
+		"1.0.1-a-b",
+		"1.0.1",
+		"1.9.0",
+		"1.10.0",
+		"1.11.0",
+		"2.0.0",
+		"10.0.0",
+		"18446744073709551615.0.0",
+	}
+
+	for i := 1; i < len(ordered); i++ {
+		prev, next := versionKey(t, ordered[i-1]), versionKey(t, ordered[i])
+		if prev >= next {
+			t.Errorf("key(%s) = %q is not less than key(%s) = %q", ordered[i-1], prev, ordered[i], next)
+		}
+	}
+}
+
+func TestVersionKeyIgnoresBuild(t *testing.T) {
+	tests := [][2]string{
+		{"1.2.3", "1.2.3+build.5"},
+		{"1.2.3-rc.1", "1.2.3-rc.1+exp.sha.5114f85"},
+	}
+	for _, tt := range tests {
+		if a, b := versionKey(t, tt[0]), versionKey(t, tt[1]); a != b {
+			t.Errorf("key(%s) = %q, key(%s) = %q, want equal", tt[0], a, tt[1], b)
+		}
+	}
+}